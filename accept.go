@@ -3,18 +3,24 @@
 package websocket
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/textproto"
 	"net/url"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"nhooyr.io/websocket/internal/errd"
 )
@@ -59,8 +65,162 @@ type AcceptOptions struct {
 	// CompressionThreshold controls the minimum size of a message before compression is applied.
 	//
 	// Defaults to 512 bytes for CompressionNoContextTakeover and 128 bytes
-	// for CompressionContextTakeover.
+	// for CompressionContextTakeover or 32 bytes with a negotiated
+	// CompressionPresetDictionary.
 	CompressionThreshold int
+
+	// CompressionPredicate, if set, decides whether a message is compressed
+	// instead of CompressionThreshold. It is passed the type of the message and
+	// its size, or with Conn.Writer, the size of the first write.
+	//
+	// WriteOptions passed to Conn.WriteWithOptions or Conn.WriterWithOptions
+	// take precedence.
+	CompressionPredicate func(typ MessageType, size int) bool
+
+	// AdaptiveCompression stops compressing messages while they compress poorly,
+	// as judged by the ratio recent messages were compressed with, and skips
+	// messages whose first write looks random. It resumes compressing when
+	// messages compress well again.
+	//
+	// Use this if some messages are compressible and others, such as images,
+	// are already compressed.
+	AdaptiveCompression bool
+
+	// CompressionBudget, if set, limits the memory held by the sliding windows
+	// of connections with context takeover. Share it across AcceptOptions to
+	// bound the memory of all of them. Connections negotiate no context takeover
+	// while it is exhausted.
+	//
+	// See docs on CompressionBudget for details.
+	CompressionBudget *CompressionBudget
+
+	// CompressionMaxWindowBits is the base 2 logarithm of the largest LZ77 sliding
+	// window, between 8 and 15, that the peer is asked to compress messages with and
+	// that messages are compressed with. Smaller windows lower the memory held by
+	// connections with context takeover at the expense of compression ratio.
+	//
+	// Defaults to 15, a 32 KiB window.
+	CompressionMaxWindowBits int
+
+	// CompressionLevel is the flate compression level messages are compressed with,
+	// from flate.HuffmanOnly (-2) to flate.BestCompression (9). Higher levels trade
+	// CPU for a better compression ratio. See the compress/flate package.
+	//
+	// With context takeover, a flate.Writer of 300 kB to 1 MB depending on the
+	// level is kept for the lifetime of every connection unless
+	// CompressionDictionarySize is set. See CompressionContextTakeover.
+	//
+	// Defaults to flate.BestSpeed with context takeover and otherwise to a fast
+	// stateless compressor.
+	CompressionLevel int
+
+	// CompressionDictionarySize is the number of bytes of previously written messages,
+	// up to 32768, used to compress messages with context takeover. Setting it
+	// avoids keeping a flate.Writer for the lifetime of the connection at the
+	// expense of compression speed. The default compression level uses at most
+	// 8192 bytes.
+	//
+	// Defaults to the entire sliding window.
+	CompressionDictionarySize int
+
+	// CompressionPresetDictionary, if set, primes the sliding windows of both sides
+	// before the first compressed message so that even small messages compress well.
+	// Use the strings common to messages such as JSON keys and enum values. Only
+	// the last 8 KiB are used with the default CompressionLevel and 32 KiB otherwise,
+	// and only levels above 6 use it for messages under 128 bytes.
+	//
+	// It is negotiated with a private parameter and only used if the peer
+	// has the same dictionary.
+	CompressionPresetDictionary []byte
+
+	// CompressionDeflateFrame enables the older x-webkit-deflate-frame extension
+	// for WebKit clients that do not support permessage-deflate. It compresses every
+	// data frame rather than every message and is configured by CompressionMode,
+	// CompressionThreshold and CompressionLevel. Clients that offer both negotiate
+	// the one they prefer.
+	//
+	// It is disabled by default due to Safari bugs.
+	// See https://github.com/nhooyr/websocket/issues/218
+	CompressionDeflateFrame bool
+
+	// Zstd, if set, enables the experimental permessage-zstd extension.
+	//
+	// See docs on ZstdOptions for details.
+	Zstd *ZstdOptions
+
+	// Extensions lists the extensions besides permessage-deflate that Accept
+	// will negotiate with the client. Offers are accepted in the order of the
+	// client's preference.
+	Extensions []Extension
+
+	// ControlTimeout bounds reading the payload of a control frame and writing
+	// a control frame such as the pong in response to a ping or a close frame.
+	// Raise it on high latency links where control frames are slow to arrive.
+	//
+	// Defaults to 5s. A negative value disables the timeout.
+	ControlTimeout time.Duration
+
+	// CloseTimeout bounds how long Close waits for the peer to respond to
+	// its close frame before closing the connection.
+	//
+	// Defaults to 5s. A negative value disables the timeout.
+	CloseTimeout time.Duration
+
+	// KeepAlive, if set, sends pings while the connection is idle and closes
+	// it if the peer stops responding.
+	//
+	// See docs on KeepAlive for details.
+	KeepAlive *KeepAlive
+
+	// OnPing, if set, is called with the payload of every ping received
+	// before the pong is written. OnPong is called with the payload of every
+	// pong received, including those in response to Ping.
+	//
+	// They are called by the goroutine reading the connection and so must not
+	// block. The payload must not be retained.
+	OnPing func(payload []byte)
+	OnPong func(payload []byte)
+
+	// HalfClose makes Close leave the connection half closed after writing the
+	// close frame instead of discarding the data messages the peer sent before it
+	// received the close frame. Keep calling Reader to drain them until it returns
+	// the peer's close frame as a CloseError. Close waits for that or CloseTimeout.
+	//
+	// Close must thus be called from a different goroutine than Reader. If the
+	// goroutine reading the connection calls it, e.g. with a deferred Close in a
+	// read loop, nothing reads the peer's close frame and Close returns an error
+	// after CloseTimeout.
+	//
+	// Use it if messages in flight must not be lost when closing.
+	HalfClose bool
+}
+
+func (opts *AcceptOptions) extensions() []Extension {
+	var exts []Extension
+	if opts.Zstd != nil && opts.Zstd.Mode != CompressionDisabled {
+		exts = append(exts, newZstdExtension(opts.Zstd))
+	}
+	if opts.CompressionMode != CompressionDisabled {
+		exts = append(exts, deflateExtension{
+			mode:       opts.CompressionMode,
+			threshold:  opts.CompressionThreshold,
+			predicate:  opts.CompressionPredicate,
+			adaptive:   opts.AdaptiveCompression,
+			windowBits: opts.CompressionMaxWindowBits,
+			level:      opts.CompressionLevel,
+			dictSize:   opts.CompressionDictionarySize,
+			dict:       opts.CompressionPresetDictionary,
+			budget:     opts.CompressionBudget,
+		})
+		if opts.CompressionDeflateFrame {
+			exts = append(exts, deflateFrameExtension{
+				mode:      opts.CompressionMode,
+				threshold: opts.CompressionThreshold,
+				level:     opts.CompressionLevel,
+			})
+		}
+	}
+	return append(exts, opts.Extensions...)
 }
 
 // Accept accepts a WebSocket handshake from a client and upgrades the
@@ -70,10 +230,162 @@ type AcceptOptions struct {
 // See the InsecureSkipVerify and OriginPatterns options to allow cross origin requests.
 //
 // Accept will write a response to w on all errors.
+//
+// HTTP/2 and HTTP/3 extended CONNECT requests are supported as per RFC 8441
+// and RFC 9220. In that case the connection runs over the HTTP/2 or HTTP/3
+// stream instead of a hijacked net.Conn and so the handler must not return
+// until the connection has been closed.
+// See https://tools.ietf.org/html/rfc8441 and https://tools.ietf.org/html/rfc9220
 func Accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (*Conn, error) {
 	return accept(w, r, opts)
 }
 
+// AcceptConn accepts a WebSocket handshake from a client directly on c
+// without going through net/http. It reads the handshake request from c,
+// verifies it and writes the response with the same rules as Accept.
+//
+// ctx bounds the handshake only. It is not used after AcceptConn returns.
+//
+// AcceptConn will write a response to c on all errors. The caller is
+// responsible for closing c if an error is returned.
+func AcceptConn(ctx context.Context, c net.Conn, opts *AcceptOptions) (*Conn, error) {
+	stop := handshakeDeadline(ctx, c)
+
+	br := bufio.NewReader(c)
+	r, err := http.ReadRequest(br)
+	if err != nil {
+		if stop() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("failed to accept WebSocket connection: failed to read handshake request: %w", err)
+	}
+	r = r.WithContext(ctx)
+	r.RemoteAddr = c.RemoteAddr().String()
+	if tc, ok := c.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		r.TLS = &state
+	}
+
+	w := &connResponseWriter{
+		c:      c,
+		br:     br,
+		r:      r,
+		header: http.Header{},
+	}
+	wc, err := accept(w, r, opts)
+	if err != nil {
+		err2 := w.finish()
+		stop()
+		if err2 != nil {
+			return nil, fmt.Errorf("%w; failed to write handshake response: %v", err, err2)
+		}
+		return nil, err
+	}
+
+	err = stop()
+	if err != nil {
+		wc.close(err)
+		return nil, fmt.Errorf("failed to accept WebSocket connection: %w", err)
+	}
+	return wc, nil
+}
+
+// connResponseWriter is the http.ResponseWriter and http.Hijacker
+// that AcceptConn passes to accept.
+type connResponseWriter struct {
+	c  net.Conn
+	br *bufio.Reader
+	r  *http.Request
+
+	header   http.Header
+	code     int
+	body     bytes.Buffer
+	hijacked bool
+}
+
+func (w *connResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *connResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *connResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+func (w *connResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.hijacked {
+		return nil, nil, errors.New("connection already hijacked")
+	}
+	w.hijacked = true
+
+	bw := bufio.NewWriter(w.c)
+	err := w.writeResponse(bw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return w.c, bufio.NewReadWriter(w.br, bw), nil
+}
+
+// finish writes the buffered response if the connection was not hijacked.
+func (w *connResponseWriter) finish() error {
+	if w.hijacked {
+		return nil
+	}
+	w.WriteHeader(http.StatusOK)
+	return w.writeResponse(bufio.NewWriter(w.c))
+}
+
+func (w *connResponseWriter) writeResponse(bw *bufio.Writer) error {
+	resp := &http.Response{
+		StatusCode: w.code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    w.r,
+		Header:     w.header,
+	}
+	if w.code != http.StatusSwitchingProtocols {
+		resp.ContentLength = int64(w.body.Len())
+		resp.Body = ioutil.NopCloser(&w.body)
+		resp.Close = true
+	}
+	err := resp.Write(bw)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// handshakeDeadline bounds reads and writes on c by ctx until the returned
+// function is called. The returned function clears the deadline and reports
+// ctx's error if it expired in the meantime.
+func handshakeDeadline(ctx context.Context, c net.Conn) (stop func() error) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	return func() error {
+		close(done)
+		<-stopped
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return c.SetDeadline(time.Time{})
+	}
+}
+
 func accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (_ *Conn, err error) {
 	defer errd.Wrap(&err, "failed to accept WebSocket connection")
 
@@ -82,6 +394,18 @@ func accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (_ *Con
 	}
 	opts = &*opts
 
+	err = verifyCompressionOptions(opts.CompressionMaxWindowBits, opts.CompressionLevel, opts.CompressionDictionarySize)
+	if err == nil {
+		err = verifyZstdOptions(opts.Zstd)
+	}
+	if err == nil {
+		err = verifyKeepAlive(opts.KeepAlive)
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, err
+	}
+
 	errCode, err := verifyClientRequest(w, r)
 	if err != nil {
 		http.Error(w, err.Error(), errCode)
@@ -100,6 +424,10 @@ func accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (_ *Con
 		}
 	}
 
+	if isExtendedConnect(r) {
+		return acceptExtendedConnect(w, r, opts)
+	}
+
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		err = errors.New("http.ResponseWriter does not implement http.Hijacker")
@@ -118,7 +446,7 @@ func accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (_ *Con
 		w.Header().Set("Sec-WebSocket-Protocol", subproto)
 	}
 
-	copts, err := acceptCompression(r, w, opts.CompressionMode)
+	exts, err := acceptExtensions(r, w, opts.extensions())
 	if err != nil {
 		return nil, err
 	}
@@ -133,6 +461,7 @@ func accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (_ *Con
 
 	netConn, brw, err := hj.Hijack()
 	if err != nil {
+		closeExtensions(exts)
 		err = fmt.Errorf("failed to hijack connection: %w", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return nil, err
@@ -143,18 +472,158 @@ func accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (_ *Con
 	brw.Reader.Reset(io.MultiReader(bytes.NewReader(b), netConn))
 
 	return newConn(connConfig{
-		subprotocol:    w.Header().Get("Sec-WebSocket-Protocol"),
-		rwc:            netConn,
-		client:         false,
-		copts:          copts,
-		flateThreshold: opts.CompressionThreshold,
+		subprotocol: w.Header().Get("Sec-WebSocket-Protocol"),
+		rwc:         netConn,
+		client:      false,
+		exts:        exts,
+
+		controlTimeout: opts.ControlTimeout,
+		closeTimeout:   opts.CloseTimeout,
+		keepAlive:      opts.KeepAlive,
+		onPing:         opts.OnPing,
+		onPong:         opts.OnPong,
+		halfClose:      opts.HalfClose,
+
+		handshake: HandshakeInfo{
+			RequestHeader:  r.Header.Clone(),
+			ResponseHeader: w.Header().Clone(),
+			LocalAddr:      netConn.LocalAddr(),
+			RemoteAddr:     netConn.RemoteAddr(),
+			TLS:            r.TLS,
+		},
 
 		br: brw.Reader,
 		bw: brw.Writer,
 	}), nil
 }
 
+func acceptExtendedConnect(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (*Conn, error) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		err := errors.New("http.ResponseWriter does not implement http.Flusher")
+		http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
+		return nil, err
+	}
+
+	subproto := selectSubprotocol(r, opts.Subprotocols)
+	if subproto != "" {
+		w.Header().Set("Sec-WebSocket-Protocol", subproto)
+	}
+
+	exts, err := acceptExtensions(r, w, opts.extensions())
+	if err != nil {
+		return nil, err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	rwc := &streamConn{
+		r:     r.Body,
+		w:     w,
+		flush: f.Flush,
+	}
+
+	localAddr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return newConn(connConfig{
+		subprotocol: w.Header().Get("Sec-WebSocket-Protocol"),
+		rwc:         rwc,
+		client:      false,
+		exts:        exts,
+
+		controlTimeout: opts.ControlTimeout,
+		closeTimeout:   opts.CloseTimeout,
+		keepAlive:      opts.KeepAlive,
+		onPing:         opts.OnPing,
+		onPong:         opts.OnPong,
+		halfClose:      opts.HalfClose,
+
+		handshake: HandshakeInfo{
+			RequestHeader:  r.Header.Clone(),
+			ResponseHeader: w.Header().Clone(),
+			LocalAddr:      localAddr,
+			RemoteAddr:     requestRemoteAddr(r),
+			TLS:            r.TLS,
+		},
+
+		br: bufio.NewReader(rwc),
+		bw: bufio.NewWriter(rwc),
+	}), nil
+}
+
+// isExtendedConnect reports whether r is a WebSocket handshake using
+// the extended CONNECT method of RFC 8441 or RFC 9220.
+func isExtendedConnect(r *http.Request) bool {
+	if r.ProtoMajor < 2 || r.Method != "CONNECT" {
+		return false
+	}
+	if r.ProtoMajor >= 3 {
+		// github.com/quic-go/quic-go/http3 sets Proto to :protocol
+		// for extended CONNECT requests.
+		return strings.EqualFold(r.Proto, "websocket")
+	}
+	// net/http and golang.org/x/net/http2 keep :protocol in Header.
+	return strings.EqualFold(r.Header.Get(":protocol"), "websocket")
+}
+
+// requestRemoteAddr returns r.RemoteAddr as a net.Addr.
+func requestRemoteAddr(r *http.Request) net.Addr {
+	if r.RemoteAddr == "" {
+		return nil
+	}
+	network := "tcp"
+	if r.ProtoMajor >= 3 {
+		network = "udp"
+	}
+	return stringAddr{network: network, addr: r.RemoteAddr}
+}
+
+type stringAddr struct {
+	network string
+	addr    string
+}
+
+func (a stringAddr) Network() string { return a.network }
+func (a stringAddr) String() string  { return a.addr }
+
+// streamConn adapts the two halves of an extended CONNECT
+// stream into an io.ReadWriteCloser.
+type streamConn struct {
+	r io.ReadCloser
+	w io.Writer
+	// flush is called after every write if set.
+	flush func()
+	// closeWrite is called on Close if set.
+	closeWrite func() error
+}
+
+func (s *streamConn) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+func (s *streamConn) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if s.flush != nil {
+		s.flush()
+	}
+	return n, nil
+}
+
+func (s *streamConn) Close() error {
+	if s.closeWrite != nil {
+		s.closeWrite()
+	}
+	return s.r.Close()
+}
+
 func verifyClientRequest(w http.ResponseWriter, r *http.Request) (errCode int, _ error) {
+	if isExtendedConnect(r) {
+		return verifyExtendedConnectRequest(w, r)
+	}
+
 	if !r.ProtoAtLeast(1, 1) {
 		return http.StatusUpgradeRequired, fmt.Errorf("WebSocket protocol violation: handshake request must be at least HTTP/1.1: %q", r.Proto)
 	}
@@ -187,6 +656,16 @@ func verifyClientRequest(w http.ResponseWriter, r *http.Request) (errCode int, _
 	return 0, nil
 }
 
+// See https://tools.ietf.org/html/rfc8441#section-5 and https://tools.ietf.org/html/rfc9220#section-3
+func verifyExtendedConnectRequest(w http.ResponseWriter, r *http.Request) (errCode int, _ error) {
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return http.StatusBadRequest, fmt.Errorf("unsupported WebSocket protocol version (only 13 is supported): %q", r.Header.Get("Sec-WebSocket-Version"))
+	}
+
+	return 0, nil
+}
+
 func authenticateOrigin(r *http.Request, originHosts []string) error {
 	origin := r.Header.Get("Origin")
 	if origin == "" {
@@ -230,85 +709,6 @@ func selectSubprotocol(r *http.Request, subprotocols []string) string {
 	return ""
 }
 
-func acceptCompression(r *http.Request, w http.ResponseWriter, mode CompressionMode) (*compressionOptions, error) {
-	if mode == CompressionDisabled {
-		return nil, nil
-	}
-
-	for _, ext := range websocketExtensions(r.Header) {
-		switch ext.name {
-		case "permessage-deflate":
-			return acceptDeflate(w, ext, mode)
-			// Disabled for now, see https://github.com/nhooyr/websocket/issues/218
-			// case "x-webkit-deflate-frame":
-			// 	return acceptWebkitDeflate(w, ext, mode)
-		}
-	}
-	return nil, nil
-}
-
-func acceptDeflate(w http.ResponseWriter, ext websocketExtension, mode CompressionMode) (*compressionOptions, error) {
-	copts := mode.opts()
-
-	for _, p := range ext.params {
-		switch p {
-		case "client_no_context_takeover":
-			copts.clientNoContextTakeover = true
-			continue
-		case "server_no_context_takeover":
-			copts.serverNoContextTakeover = true
-			continue
-		}
-
-		if strings.HasPrefix(p, "client_max_window_bits") {
-			// We cannot adjust the read sliding window so cannot make use of this.
-			continue
-		}
-
-		err := fmt.Errorf("unsupported permessage-deflate parameter: %q", p)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return nil, err
-	}
-
-	copts.setHeader(w.Header())
-
-	return copts, nil
-}
-
-func acceptWebkitDeflate(w http.ResponseWriter, ext websocketExtension, mode CompressionMode) (*compressionOptions, error) {
-	copts := mode.opts()
-	// The peer must explicitly request it.
-	copts.serverNoContextTakeover = false
-
-	for _, p := range ext.params {
-		if p == "no_context_takeover" {
-			copts.serverNoContextTakeover = true
-			continue
-		}
-
-		// We explicitly fail on x-webkit-deflate-frame's max_window_bits parameter instead
-		// of ignoring it as the draft spec is unclear. It says the server can ignore it
-		// but the server has no way of signalling to the client it was ignored as the parameters
-		// are set one way.
-		// Thus us ignoring it would make the client think we understood it which would cause issues.
-		// See https://tools.ietf.org/html/draft-tyoshino-hybi-websocket-perframe-deflate-06#section-4.1
-		//
-		// Either way, we're only implementing this for webkit which never sends the max_window_bits
-		// parameter so we don't need to worry about it.
-		err := fmt.Errorf("unsupported x-webkit-deflate-frame parameter: %q", p)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return nil, err
-	}
-
-	s := "x-webkit-deflate-frame"
-	if copts.clientNoContextTakeover {
-		s += "; no_context_takeover"
-	}
-	w.Header().Set("Sec-WebSocket-Extensions", s)
-
-	return copts, nil
-}
-
 func headerContainsToken(h http.Header, key, token string) bool {
 	token = strings.ToLower(token)
 
@@ -3,15 +3,31 @@ package websocket
 import (
 	"errors"
 	"net/http"
+	"time"
 )
 
 // AcceptOptions represents Accept's options.
 type AcceptOptions struct {
-	Subprotocols         []string
-	InsecureSkipVerify   bool
-	OriginPatterns       []string
-	CompressionMode      CompressionMode
-	CompressionThreshold int
+	Subprotocols                []string
+	InsecureSkipVerify          bool
+	OriginPatterns              []string
+	CompressionMode             CompressionMode
+	CompressionThreshold        int
+	CompressionPredicate        func(typ MessageType, size int) bool
+	AdaptiveCompression         bool
+	CompressionBudget           *CompressionBudget
+	CompressionMaxWindowBits    int
+	CompressionLevel            int
+	CompressionDictionarySize   int
+	CompressionPresetDictionary []byte
+	CompressionDeflateFrame     bool
+	Zstd                        *ZstdOptions
+	ControlTimeout              time.Duration
+	CloseTimeout                time.Duration
+	KeepAlive                   *KeepAlive
+	OnPing                      func(payload []byte)
+	OnPong                      func(payload []byte)
+	HalfClose                   bool
 }
 
 // Accept is stubbed out for Wasm.
@@ -4,12 +4,14 @@ package websocket
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"nhooyr.io/websocket/internal/test/assert"
 )
@@ -45,8 +47,12 @@ func TestAccept(t *testing.T) {
 	t.Run("badCompression", func(t *testing.T) {
 		t.Parallel()
 
+		rec := httptest.NewRecorder()
 		w := mockHijacker{
-			ResponseWriter: httptest.NewRecorder(),
+			ResponseWriter: rec,
+			hijack: func() (conn net.Conn, writer *bufio.ReadWriter, err error) {
+				return nil, nil, errors.New("haha")
+			},
 		}
 		r := httptest.NewRequest("GET", "/", nil)
 		r.Header.Set("Connection", "Upgrade")
@@ -55,8 +61,10 @@ func TestAccept(t *testing.T) {
 		r.Header.Set("Sec-WebSocket-Key", "meow123")
 		r.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate; harharhar")
 
+		// The offer is declined rather than failing the handshake.
 		_, err := Accept(w, r, nil)
-		assert.Contains(t, err, `unsupported permessage-deflate parameter`)
+		assert.Contains(t, err, `failed to hijack connection`)
+		assert.Equal(t, "Sec-WebSocket-Extensions", "", rec.Header().Get("Sec-WebSocket-Extensions"))
 	})
 
 	t.Run("requireHttpHijacker", func(t *testing.T) {
@@ -94,6 +102,99 @@ func TestAccept(t *testing.T) {
 	})
 }
 
+func TestAcceptConn(t *testing.T) {
+	t.Parallel()
+
+	t.Run("echo", func(t *testing.T) {
+		t.Parallel()
+
+		c1, c2 := net.Pipe()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		errs := make(chan error, 1)
+		go func() {
+			c, err := AcceptConn(ctx, c2, &AcceptOptions{
+				Subprotocols: []string{"echo"},
+			})
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer c.Close(StatusInternalError, "")
+
+			typ, p, err := c.Read(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			err = c.Write(ctx, typ, p)
+			if err != nil {
+				errs <- err
+				return
+			}
+			errs <- c.Close(StatusNormalClosure, "")
+		}()
+
+		c, resp, err := ClientHandshake(ctx, c1, "ws://example.com", &DialOptions{
+			Subprotocols: []string{"echo"},
+		})
+		assert.Success(t, err)
+		assert.Equal(t, "status code", http.StatusSwitchingProtocols, resp.StatusCode)
+		assert.Equal(t, "subprotocol", "echo", c.Subprotocol())
+
+		assertEcho(ctx, t, c)
+		assert.Success(t, <-errs)
+	})
+
+	t.Run("badClientHandshake", func(t *testing.T) {
+		t.Parallel()
+
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := AcceptConn(ctx, c2, nil)
+			errs <- err
+		}()
+
+		req, _ := http.NewRequest("GET", "http://example.com", nil)
+		err := req.Write(c1)
+		assert.Success(t, err)
+
+		resp, err := http.ReadResponse(bufio.NewReader(c1), req)
+		assert.Success(t, err)
+		assert.Equal(t, "status code", http.StatusUpgradeRequired, resp.StatusCode)
+		assert.Equal(t, "upgrade", "websocket", resp.Header.Get("Upgrade"))
+
+		err = <-errs
+		assert.Contains(t, err, "protocol violation")
+	})
+
+	t.Run("contextExpired", func(t *testing.T) {
+		t.Parallel()
+
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+
+		_, err := AcceptConn(ctx, c2, nil)
+		assert.Error(t, err)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected context.DeadlineExceeded: %v", err)
+		}
+	})
+}
+
 func Test_verifyClientHandshake(t *testing.T) {
 	t.Parallel()
 
@@ -101,6 +202,8 @@ func Test_verifyClientHandshake(t *testing.T) {
 		name    string
 		method  string
 		http1   bool
+		http2   bool
+		http3   bool
 		h       map[string]string
 		success bool
 	}{
@@ -162,6 +265,43 @@ func Test_verifyClientHandshake(t *testing.T) {
 			},
 			success: true,
 		},
+		{
+			name:   "extendedConnect",
+			method: "CONNECT",
+			http2:  true,
+			h: map[string]string{
+				":protocol":             "websocket",
+				"Sec-WebSocket-Version": "13",
+			},
+			success: true,
+		},
+		{
+			name:   "extendedConnect/badWebSocketVersion",
+			method: "CONNECT",
+			http2:  true,
+			h: map[string]string{
+				":protocol":             "websocket",
+				"Sec-WebSocket-Version": "14",
+			},
+		},
+		{
+			name:   "extendedConnect/http3",
+			method: "CONNECT",
+			http3:  true,
+			h: map[string]string{
+				"Sec-WebSocket-Version": "13",
+			},
+			success: true,
+		},
+		{
+			name:   "extendedConnect/badProtocol",
+			method: "CONNECT",
+			http2:  true,
+			h: map[string]string{
+				":protocol":             "webtransport",
+				"Sec-WebSocket-Version": "13",
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -176,6 +316,15 @@ func Test_verifyClientHandshake(t *testing.T) {
 			if tc.http1 {
 				r.ProtoMinor = 0
 			}
+			if tc.http2 {
+				r.ProtoMajor = 2
+				r.ProtoMinor = 0
+			}
+			if tc.http3 {
+				r.Proto = "websocket"
+				r.ProtoMajor = 3
+				r.ProtoMinor = 0
+			}
 
 			for k, v := range tc.h {
 				r.Header.Set(k, v)
@@ -325,6 +474,10 @@ func Test_acceptCompression(t *testing.T) {
 	testCases := []struct {
 		name                       string
 		mode                       CompressionMode
+		windowBits                 int
+		dict                       []byte
+		zstd                       *ZstdOptions
+		deflateFrame               bool
 		reqSecWebSocketExtensions  string
 		respSecWebSocketExtensions string
 		expCopts                   *compressionOptions
@@ -348,30 +501,174 @@ func Test_acceptCompression(t *testing.T) {
 			expCopts: &compressionOptions{
 				clientNoContextTakeover: true,
 				serverNoContextTakeover: true,
+				clientMaxWindowBits:     15,
+				serverMaxWindowBits:     15,
 			},
 		},
 		{
-			name:                      "permessage-deflate/error",
+			name:                      "permessage-deflate/unknownParameter",
 			mode:                      CompressionNoContextTakeover,
 			reqSecWebSocketExtensions: "permessage-deflate; meow",
+		},
+		{
+			name:                       "permessage-deflate/nextOffer",
+			mode:                       CompressionNoContextTakeover,
+			reqSecWebSocketExtensions:  "permessage-deflate; meow, permessage-deflate",
+			respSecWebSocketExtensions: "permessage-deflate; client_no_context_takeover; server_no_context_takeover",
+			expCopts: &compressionOptions{
+				clientNoContextTakeover: true,
+				serverNoContextTakeover: true,
+				clientMaxWindowBits:     15,
+				serverMaxWindowBits:     15,
+			},
+		},
+		{
+			name:                      "permessage-deflate/repeatedParameter",
+			mode:                      CompressionNoContextTakeover,
+			reqSecWebSocketExtensions: "permessage-deflate; client_no_context_takeover; client_no_context_takeover",
+		},
+		{
+			name:                      "permessage-deflate/parameterValue",
+			mode:                      CompressionNoContextTakeover,
+			reqSecWebSocketExtensions: "permessage-deflate; server_no_context_takeover=1",
+		},
+		{
+			name:                       "permessage-deflate/windowBits",
+			mode:                       CompressionContextTakeover,
+			reqSecWebSocketExtensions:  `permessage-deflate; client_max_window_bits=12; server_max_window_bits="10"`,
+			respSecWebSocketExtensions: "permessage-deflate; client_max_window_bits=12; server_max_window_bits=10",
+			expCopts: &compressionOptions{
+				clientMaxWindowBits:        12,
+				serverMaxWindowBits:        10,
+				serverMaxWindowBitsOffered: true,
+			},
+		},
+		{
+			name:                       "permessage-deflate/fullWindowBits",
+			mode:                       CompressionContextTakeover,
+			reqSecWebSocketExtensions:  "permessage-deflate; server_max_window_bits=15",
+			respSecWebSocketExtensions: "permessage-deflate; server_max_window_bits=15",
+			expCopts: &compressionOptions{
+				clientMaxWindowBits:        15,
+				serverMaxWindowBits:        15,
+				serverMaxWindowBitsOffered: true,
+			},
+		},
+		{
+			name:                       "permessage-deflate/maxWindowBits",
+			mode:                       CompressionContextTakeover,
+			windowBits:                 9,
+			reqSecWebSocketExtensions:  "permessage-deflate; client_max_window_bits; server_max_window_bits=10",
+			respSecWebSocketExtensions: "permessage-deflate; client_max_window_bits=9; server_max_window_bits=9",
+			expCopts: &compressionOptions{
+				clientMaxWindowBits:        9,
+				serverMaxWindowBits:        9,
+				serverMaxWindowBitsOffered: true,
+			},
+		},
+		{
+			name:                       "permessage-deflate/maxWindowBitsNoClientSupport",
+			mode:                       CompressionContextTakeover,
+			windowBits:                 9,
+			reqSecWebSocketExtensions:  "permessage-deflate",
+			respSecWebSocketExtensions: "permessage-deflate; server_max_window_bits=9",
+			expCopts: &compressionOptions{
+				clientMaxWindowBits: 15,
+				serverMaxWindowBits: 9,
+			},
+		},
+		{
+			name:                      "permessage-deflate/invalidWindowBits",
+			mode:                      CompressionContextTakeover,
+			reqSecWebSocketExtensions: "permessage-deflate; server_max_window_bits=16",
+		},
+		{
+			name:                      "permessage-deflate/missingWindowBits",
+			mode:                      CompressionContextTakeover,
+			reqSecWebSocketExtensions: "permessage-deflate; server_max_window_bits",
+		},
+		{
+			name:                       "permessage-deflate/dictionary",
+			mode:                       CompressionContextTakeover,
+			dict:                       []byte("hello"),
+			reqSecWebSocketExtensions:  "permessage-deflate; x_dictionary_id=103547413",
+			respSecWebSocketExtensions: "permessage-deflate; x_dictionary_id=103547413",
+			expCopts: &compressionOptions{
+				clientMaxWindowBits: 15,
+				serverMaxWindowBits: 15,
+				dictionaryID:        103547413,
+			},
+		},
+		{
+			name:                       "permessage-deflate/otherDictionary",
+			mode:                       CompressionContextTakeover,
+			dict:                       []byte("world"),
+			reqSecWebSocketExtensions:  "permessage-deflate; x_dictionary_id=103547413",
+			respSecWebSocketExtensions: "permessage-deflate",
+			expCopts: &compressionOptions{
+				clientMaxWindowBits: 15,
+				serverMaxWindowBits: 15,
+			},
+		},
+		{
+			name:                      "permessage-deflate/invalidDictionary",
+			mode:                      CompressionContextTakeover,
+			reqSecWebSocketExtensions: "permessage-deflate; x_dictionary_id=0",
+		},
+		{
+			name:                       "x-permessage-zstd/unknownParameter",
+			mode:                       CompressionNoContextTakeover,
+			zstd:                       &ZstdOptions{},
+			reqSecWebSocketExtensions:  "x-permessage-zstd; bogus, permessage-deflate",
+			respSecWebSocketExtensions: "permessage-deflate; client_no_context_takeover; server_no_context_takeover",
+			expCopts: &compressionOptions{
+				clientNoContextTakeover: true,
+				serverNoContextTakeover: true,
+				clientMaxWindowBits:     15,
+				serverMaxWindowBits:     15,
+			},
+		},
+		{
+			name:                      "x-webkit-deflate-frame/disabled",
+			mode:                      CompressionNoContextTakeover,
+			reqSecWebSocketExtensions: "x-webkit-deflate-frame",
+		},
+		{
+			name:                       "x-webkit-deflate-frame",
+			mode:                       CompressionNoContextTakeover,
+			deflateFrame:               true,
+			reqSecWebSocketExtensions:  "x-webkit-deflate-frame; no_context_takeover",
+			respSecWebSocketExtensions: "x-webkit-deflate-frame; no_context_takeover",
+			expCopts: &compressionOptions{
+				clientNoContextTakeover: true,
+				serverNoContextTakeover: true,
+			},
+		},
+		{
+			name:                       "x-webkit-deflate-frame/contextTakeover",
+			mode:                       CompressionContextTakeover,
+			deflateFrame:               true,
+			reqSecWebSocketExtensions:  "x-webkit-deflate-frame",
+			respSecWebSocketExtensions: "x-webkit-deflate-frame",
+			expCopts:                   &compressionOptions{},
+		},
+		{
+			name:                       "x-webkit-deflate-frame/noContextTakeover",
+			mode:                       CompressionContextTakeover,
+			deflateFrame:               true,
+			reqSecWebSocketExtensions:  "x-webkit-deflate-frame; no_context_takeover",
+			respSecWebSocketExtensions: "x-webkit-deflate-frame",
+			expCopts: &compressionOptions{
+				serverNoContextTakeover: true,
+			},
+		},
+		{
+			name:                      "x-webkit-deflate-frame/error",
+			mode:                      CompressionNoContextTakeover,
+			deflateFrame:              true,
+			reqSecWebSocketExtensions: "x-webkit-deflate-frame; max_window_bits",
 			error:                     true,
 		},
-		// {
-		// 	name:                       "x-webkit-deflate-frame",
-		// 	mode:                       CompressionNoContextTakeover,
-		// 	reqSecWebSocketExtensions:  "x-webkit-deflate-frame; no_context_takeover",
-		// 	respSecWebSocketExtensions: "x-webkit-deflate-frame; no_context_takeover",
-		// 	expCopts: &compressionOptions{
-		// 		clientNoContextTakeover: true,
-		// 		serverNoContextTakeover: true,
-		// 	},
-		// },
-		// {
-		// 	name:                      "x-webkit-deflate/error",
-		// 	mode:                      CompressionNoContextTakeover,
-		// 	reqSecWebSocketExtensions: "x-webkit-deflate-frame; max_window_bits",
-		// 	error:                     true,
-		// },
 	}
 
 	for _, tc := range testCases {
@@ -382,14 +679,32 @@ func Test_acceptCompression(t *testing.T) {
 			r := httptest.NewRequest(http.MethodGet, "/", nil)
 			r.Header.Set("Sec-WebSocket-Extensions", tc.reqSecWebSocketExtensions)
 
+			opts := &AcceptOptions{
+				CompressionMode:             tc.mode,
+				CompressionMaxWindowBits:    tc.windowBits,
+				CompressionPresetDictionary: tc.dict,
+				Zstd:                        tc.zstd,
+				CompressionDeflateFrame:     tc.deflateFrame,
+			}
 			w := httptest.NewRecorder()
-			copts, err := acceptCompression(r, w, tc.mode)
+			exts, err := acceptExtensions(r, w, opts.extensions())
 			if tc.error {
 				assert.Error(t, err)
 				return
 			}
-
 			assert.Success(t, err)
+			var copts *compressionOptions
+			if len(exts) > 0 {
+				switch ec := exts[0].(type) {
+				case *deflateConn:
+					copts = &ec.compressionOptions
+				case *deflateFrameConn:
+					copts = &compressionOptions{
+						clientNoContextTakeover: !ec.readContextTakeover,
+						serverNoContextTakeover: !ec.writeContextTakeover,
+					}
+				}
+			}
 			assert.Equal(t, "compression options", tc.expCopts, copts)
 			assert.Equal(t, "Sec-WebSocket-Extensions", tc.respSecWebSocketExtensions, w.Header().Get("Sec-WebSocket-Extensions"))
 		})
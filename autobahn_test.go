@@ -25,11 +25,6 @@ var excludedAutobahnCases = []string{
 	// We skip the UTF-8 handling tests as there isn't any reason to reject invalid UTF-8, just
 	// more performance overhead.
 	"6.*", "7.5.1",
-
-	// We skip the tests related to requestMaxWindowBits as that is unimplemented due
-	// to limitations in compress/flate. See https://github.com/golang/go/issues/3155
-	// Same with klauspost/compress which doesn't allow adjusting the sliding window size.
-	"13.3.*", "13.4.*", "13.5.*", "13.6.*",
 }
 
 var autobahnCases = []string{"*"}
@@ -69,7 +64,7 @@ func TestAutobahn(t *testing.T) {
 		}
 	})
 
-	c, _, err := websocket.Dial(ctx, fmt.Sprintf(wstestURL+"/updateReports?agent=main"), nil)
+	c, _, err := websocket.Dial(ctx, wstestURL+"/updateReports?agent=main", nil)
 	assert.Success(t, err)
 	c.Close(websocket.StatusNormalClosure, "")
 
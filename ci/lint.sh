@@ -6,6 +6,7 @@ main() {
 
   go vet ./...
   GOOS=js GOARCH=wasm go vet ./...
+  (cd internal/test/h3 && go vet ./...)
 
   golint -set_exit_status ./...
   GOOS=js GOARCH=wasm golint -set_exit_status ./...
@@ -5,6 +5,9 @@ main() {
   cd "$(dirname "$0")/.."
 
   go test -timeout=30m -covermode=atomic -coverprofile=ci/out/coverage.prof -coverpkg=./... "$@" ./...
+  # The HTTP/2 and HTTP/3 interop tests are a separate module so that
+  # the library does not depend on x/net and quic-go.
+  (cd internal/test/h3 && go test "$@" ./...)
   sed -i '/stringer\.go/d' ci/out/coverage.prof
   sed -i '/nhooyr.io\/websocket\/internal\/test/d' ci/out/coverage.prof
   sed -i '/examples/d' ci/out/coverage.prof
@@ -63,6 +63,40 @@ func (ce CloseError) Error() string {
 	return fmt.Sprintf("status = %v and reason = %q", ce.Code, ce.Reason)
 }
 
+// CloseInitiator identifies the side that started closing a connection.
+type CloseInitiator int
+
+// CloseInitiator constants.
+const (
+	// CloseInitiatorNone means the connection is open or was
+	// lost before either side started closing it.
+	CloseInitiatorNone CloseInitiator = iota
+	// CloseInitiatorLocal means the connection was closed with Close,
+	// CloseNow or because of an error detected locally.
+	CloseInitiatorLocal
+	// CloseInitiatorPeer means the peer sent the first close frame.
+	CloseInitiatorPeer
+)
+
+// CloseInfo describes how a connection was closed.
+// See Conn.CloseInfo.
+type CloseInfo struct {
+	// Initiator is the side that started closing the connection.
+	Initiator CloseInitiator
+
+	// Clean reports whether the close handshake completed,
+	// that is a close frame was both sent and received.
+	Clean bool
+
+	// Sent is the close frame sent to the peer.
+	// It is nil if none was sent.
+	Sent *CloseError
+
+	// Received is the close frame received from the peer.
+	// It is nil if none was received.
+	Received *CloseError
+}
+
 // CloseStatus is a convenience wrapper around Go 1.13's errors.As to grab
 // the status code from a CloseError.
 //
@@ -8,16 +8,16 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"time"
 
 	"nhooyr.io/websocket/internal/errd"
 )
 
 // Close performs the WebSocket close handshake with the given status code and reason.
 //
-// It will write a WebSocket close frame with a timeout of 5s and then wait 5s for
-// the peer to send a close frame.
-// All data messages received from the peer during the close handshake will be discarded.
+// It will write a WebSocket close frame with a timeout of ControlTimeout and then
+// wait CloseTimeout for the peer to send a close frame. Both default to 5s.
+// All data messages received from the peer during the close handshake will be discarded
+// unless the HalfClose option is set.
 //
 // The connection can only be closed once. Additional calls to Close
 // are no-ops.
@@ -26,16 +26,54 @@ import (
 // sending a dynamic reason.
 //
 // Close will unblock all goroutines interacting with the connection once
-// complete.
+// complete. See CloseInfo for how the close handshake went.
 func (c *Conn) Close(code StatusCode, reason string) error {
-	return c.closeHandshake(code, reason)
+	return c.closeHandshake(context.Background(), code, reason)
 }
 
-func (c *Conn) closeHandshake(code StatusCode, reason string) (err error) {
+// CloseNow closes the connection immediately without a close handshake.
+// The peer sees the connection closed abnormally.
+//
+// Use it when the peer cannot be waited on, e.g. when it is misbehaving
+// or on shutdown. Otherwise prefer Close.
+func (c *Conn) CloseNow() error {
+	c.closeMu.Lock()
+	c.setCloseInitiatorLocked(CloseInitiatorLocal)
+	// Close frames can no longer be written.
+	c.wroteClose = true
+	c.closeMu.Unlock()
+
+	c.close(errors.New("closed without a close handshake"))
+	return nil
+}
+
+// CloseInfo describes how the connection was closed. It is only
+// complete once the connection is closed, e.g. once Close returns
+// or Reader returns an error.
+func (c *Conn) CloseInfo() CloseInfo {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	ci := c.closeInfo
+	ci.Clean = ci.Sent != nil && ci.Received != nil
+	return ci
+}
+
+// CloseContext is like Close but the whole close handshake is also bounded
+// by ctx. The connection is closed once ctx is done even if the peer has
+// not yet responded.
+//
+// ControlTimeout and CloseTimeout still apply. Set them to a negative
+// value to bound the close handshake by ctx alone.
+func (c *Conn) CloseContext(ctx context.Context, code StatusCode, reason string) error {
+	return c.closeHandshake(ctx, code, reason)
+}
+
+func (c *Conn) closeHandshake(ctx context.Context, code StatusCode, reason string) (err error) {
 	defer errd.Wrap(&err, "failed to close WebSocket")
 
-	writeErr := c.writeClose(code, reason)
-	closeHandshakeErr := c.waitCloseHandshake()
+	writeErr := c.writeClose(ctx, code, reason)
+	closeHandshakeErr := c.waitCloseHandshake(ctx)
 
 	if writeErr != nil {
 		return writeErr
@@ -50,10 +88,13 @@ func (c *Conn) closeHandshake(code StatusCode, reason string) (err error) {
 
 var errAlreadyWroteClose = errors.New("already wrote close")
 
-func (c *Conn) writeClose(code StatusCode, reason string) error {
+func (c *Conn) writeClose(ctx context.Context, code StatusCode, reason string) error {
 	c.closeMu.Lock()
 	wroteClose := c.wroteClose
 	c.wroteClose = true
+	if !wroteClose {
+		c.setCloseInitiatorLocked(CloseInitiatorLocal)
+	}
 	c.closeMu.Unlock()
 	if wroteClose {
 		return errAlreadyWroteClose
@@ -66,14 +107,21 @@ func (c *Conn) writeClose(code StatusCode, reason string) error {
 
 	var p []byte
 	var marshalErr error
+	sent := ce
 	if ce.Code != StatusNoStatusRcvd {
 		p, marshalErr = ce.bytes()
 		if marshalErr != nil {
 			log.Printf("websocket: %v", marshalErr)
+			sent = CloseError{Code: StatusInternalError}
 		}
 	}
 
-	writeErr := c.writeControl(context.Background(), opClose, p)
+	writeErr := c.writeControl(ctx, opClose, p)
+	if writeErr == nil {
+		c.closeMu.Lock()
+		c.closeInfo.Sent = &sent
+		c.closeMu.Unlock()
+	}
 	if CloseStatus(writeErr) != -1 {
 		// Not a real error if it's due to a close frame being received.
 		writeErr = nil
@@ -88,12 +136,16 @@ func (c *Conn) writeClose(code StatusCode, reason string) error {
 	return writeErr
 }
 
-func (c *Conn) waitCloseHandshake() error {
+func (c *Conn) waitCloseHandshake(ctx context.Context) error {
 	defer c.close(nil)
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, cancel := withTimeout(ctx, c.closeTimeout)
 	defer cancel()
 
+	if c.halfClose {
+		return c.waitHalfClose(ctx)
+	}
+
 	err := c.readMu.lock(ctx)
 	if err != nil {
 		return err
@@ -119,6 +171,24 @@ func (c *Conn) waitCloseHandshake() error {
 	}
 }
 
+// waitHalfClose waits for Reader to receive the peer's close frame
+// after draining the data messages before it.
+func (c *Conn) waitHalfClose(ctx context.Context) error {
+	select {
+	case <-c.closed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	c.closeMu.Lock()
+	received := c.closeInfo.Received
+	c.closeMu.Unlock()
+	if received == nil {
+		return errors.New("connection closed before receiving the peer's close frame")
+	}
+	return *received
+}
+
 func parseClosePayload(p []byte) (CloseError, error) {
 	if len(p) == 0 {
 		return CloseError{
@@ -201,6 +271,14 @@ func (c *Conn) setCloseErrLocked(err error) {
 	}
 }
 
+// setCloseInitiatorLocked records the side that started closing the
+// connection unless it was already recorded or the connection was lost.
+func (c *Conn) setCloseInitiatorLocked(initiator CloseInitiator) {
+	if c.closeInfo.Initiator == CloseInitiatorNone && !c.isClosed() {
+		c.closeInfo.Initiator = initiator
+	}
+}
+
 func (c *Conn) isClosed() bool {
 	select {
 	case <-c.closed:
@@ -1,5 +1,10 @@
 package websocket
 
+import (
+	"sync"
+	"time"
+)
+
 // CompressionMode represents the modes available to the deflate extension.
 // See https://tools.ietf.org/html/rfc7692
 //
@@ -7,7 +12,8 @@ package websocket
 // by safari. See https://tools.ietf.org/html/draft-tyoshino-hybi-websocket-perframe-deflate-06
 // It will work the same in every way except that we cannot signal to the peer we
 // want to use no context takeover on our side, we can only signal that they should.
-// It is however currently disabled due to Safari bugs. See https://github.com/nhooyr/websocket/issues/218
+// It is however disabled by default due to Safari bugs. See https://github.com/nhooyr/websocket/issues/218
+// Enable it with AcceptOptions.CompressionDeflateFrame.
 type CompressionMode int
 
 const (
@@ -24,7 +30,15 @@ const (
 	// CompressionContextTakeover uses a flate.Reader and flate.Writer per connection.
 	// This enables reusing the sliding window from previous messages.
 	// As most WebSocket protocols are repetitive, this can be very efficient.
-	// It carries an overhead of 8 kB for every connection compared to CompressionNoContextTakeover.
+	// It carries an overhead of a 32 kB sliding window to decompress and a
+	// flate.Writer to compress for every connection compared to
+	// CompressionNoContextTakeover. The flate.Writer holds about 470 kB with the
+	// default flate.BestSpeed level, 300 kB with flate.HuffmanOnly, 730 kB with
+	// flate.DefaultCompression and 990 kB with flate.BestCompression.
+	//
+	// Set CompressionDictionarySize to instead keep only that many bytes of the
+	// previous messages at the expense of compression speed, or use a
+	// CompressionBudget to bound the memory of all the connections.
 	//
 	// If the peer negotiates NoContextTakeover on the client or server side, it will be
 	// used instead as this is required by the RFC.
@@ -37,3 +51,118 @@ const (
 	// important than bandwidth.
 	CompressionDisabled
 )
+
+// MessageCompression overrides whether a message is compressed.
+// See WriteOptions.
+type MessageCompression int
+
+const (
+	// MessageCompressionDefault compresses the message according to the
+	// connection's CompressionPredicate or CompressionThreshold.
+	MessageCompressionDefault MessageCompression = iota
+
+	// MessageCompressionForce compresses the message regardless of its size
+	// if compression was negotiated.
+	MessageCompressionForce
+
+	// MessageCompressionSkip writes the message uncompressed.
+	//
+	// Use this for payloads that are already compressed such as images.
+	MessageCompressionSkip
+)
+
+// CompressionBudget limits the memory held by the sliding windows of connections
+// that compress with context takeover. Share one across AcceptOptions to bound
+// the memory of all the connections of a server.
+//
+// Every connection reserves the window used to decompress messages and the
+// dictionary used to compress them, see AcceptOptions.CompressionDictionarySize.
+// With a budget, messages are always compressed with the dictionary rather than
+// a flate.Writer kept for the lifetime of the connection.
+//
+// Once the budget is exhausted, new connections negotiate no context takeover.
+//
+// It is only used by Accept as a client cannot decline the context takeover
+// the server chooses.
+//
+// A CompressionBudget must not be copied or modified after first use.
+type CompressionBudget struct {
+	// Max is the most bytes of sliding windows held at once.
+	Max int64
+
+	// IdleTimeout, if set, releases the sliding windows of connections that have
+	// not used them for that long.
+	//
+	// The dictionary used to compress is released even while a message is
+	// written so a Writer left open does not keep it. The window used to
+	// decompress is compressed instead as the peer may still reference it, and
+	// restored once the next message arrives even if that exceeds Max.
+	IdleTimeout time.Duration
+
+	mu   sync.Mutex
+	used int64
+}
+
+// Used returns the bytes of sliding windows held.
+func (b *CompressionBudget) Used() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+func (b *CompressionBudget) reserve(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.Max {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// take reserves n even if it exceeds Max.
+func (b *CompressionBudget) take(n int64) {
+	b.mu.Lock()
+	b.used += n
+	b.mu.Unlock()
+}
+
+func (b *CompressionBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+}
+
+// ZstdOptions configures the experimental permessage-zstd extension which
+// compresses messages with zstd for a better ratio and speed than deflate.
+//
+// It is negotiated with the private extension token x-permessage-zstd and so
+// only between peers using this package. It is preferred to permessage-deflate
+// when both are enabled as they cannot be used together.
+type ZstdOptions struct {
+	// Mode controls the compression mode like CompressionMode.
+	// Defaults to CompressionNoContextTakeover.
+	//
+	// With CompressionContextTakeover, messages are compressed as a single
+	// zstd stream with a 32 KiB window for the lifetime of the connection.
+	Mode CompressionMode
+
+	// Threshold controls the minimum size of a message before compression is applied.
+	//
+	// Defaults to 512 bytes for CompressionNoContextTakeover and 128 bytes
+	// for CompressionContextTakeover.
+	Threshold int
+
+	// Level is the zstd compression level, from 1 to 22 as with the zstd command,
+	// mapped to the closest level supported by github.com/klauspost/compress/zstd.
+	//
+	// Defaults to 3.
+	Level int
+
+	// Dictionary, if set, is a pre-shared dictionary messages are compressed with.
+	// It is either a dictionary in the zstd format, such as one trained with
+	// zstd --train, or raw content such as sample messages.
+	//
+	// It is only used if the peer has the same dictionary.
+	Dictionary []byte
+}
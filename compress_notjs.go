@@ -3,9 +3,17 @@
 package websocket
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/adler32"
 	"io"
-	"net/http"
+	"math"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/klauspost/compress/flate"
 )
@@ -14,23 +22,984 @@ func (m CompressionMode) opts() *compressionOptions {
 	return &compressionOptions{
 		clientNoContextTakeover: m == CompressionNoContextTakeover,
 		serverNoContextTakeover: m == CompressionNoContextTakeover,
+		clientMaxWindowBits:     maxWindowBits,
+		serverMaxWindowBits:     maxWindowBits,
 	}
 }
 
 type compressionOptions struct {
 	clientNoContextTakeover bool
 	serverNoContextTakeover bool
+	clientMaxWindowBits     int
+	serverMaxWindowBits     int
+	// dictionaryID is the Adler-32 checksum of the negotiated preset
+	// dictionary or 0 if none.
+	dictionaryID uint32
+	// serverMaxWindowBitsOffered is set when the client offered
+	// server_max_window_bits as the server then has to respond with it.
+	// See https://tools.ietf.org/html/rfc7692#section-7.1.2.1
+	serverMaxWindowBitsOffered bool
 }
 
-func (copts *compressionOptions) setHeader(h http.Header) {
-	s := "permessage-deflate"
+// The range of LZ77 sliding window sizes permessage-deflate can negotiate.
+// See https://tools.ietf.org/html/rfc7692#section-7.1.2
+const (
+	minWindowBits = 8
+	maxWindowBits = 15
+)
+
+func verifyWindowBits(bits int) error {
+	if bits != 0 && (bits < minWindowBits || bits > maxWindowBits) {
+		return fmt.Errorf("CompressionMaxWindowBits must be between %v and %v: %v", minWindowBits, maxWindowBits, bits)
+	}
+	return nil
+}
+
+func verifyCompressionOptions(windowBits, level, dictSize int) error {
+	err := verifyWindowBits(windowBits)
+	if err != nil {
+		return err
+	}
+	err = verifyCompressionLevel(level)
+	if err != nil {
+		return err
+	}
+	return verifyDictionarySize(dictSize)
+}
+
+func verifyCompressionLevel(level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return fmt.Errorf("CompressionLevel must be between %v and %v: %v", flate.HuffmanOnly, flate.BestCompression, level)
+	}
+	return nil
+}
+
+// maxDictionarySize is the largest dictionary a deflate stream can reference.
+const maxDictionarySize = 1 << maxWindowBits
+
+func verifyDictionarySize(n int) error {
+	if n < 0 || n > maxDictionarySize {
+		return fmt.Errorf("CompressionDictionarySize must be between 0 and %v: %v", maxDictionarySize, n)
+	}
+	return nil
+}
+
+// CompressionInfo describes negotiated permessage-deflate parameters.
+// See https://tools.ietf.org/html/rfc7692#section-7.1
+type CompressionInfo struct {
+	ClientNoContextTakeover bool
+	ServerNoContextTakeover bool
+
+	// ClientMaxWindowBits and ServerMaxWindowBits are the base 2 logarithm
+	// of the LZ77 sliding window sizes each side compresses with.
+	ClientMaxWindowBits int
+	ServerMaxWindowBits int
+
+	// PresetDictionary reports whether both sides prime their sliding windows
+	// with the preset dictionary. See CompressionPresetDictionary.
+	PresetDictionary bool
+}
+
+func (copts *compressionOptions) info() *CompressionInfo {
+	return &CompressionInfo{
+		ClientNoContextTakeover: copts.clientNoContextTakeover,
+		ServerNoContextTakeover: copts.serverNoContextTakeover,
+		ClientMaxWindowBits:     copts.clientMaxWindowBits,
+		ServerMaxWindowBits:     copts.serverMaxWindowBits,
+		PresetDictionary:        copts.dictionaryID != 0,
+	}
+}
+
+func (copts *compressionOptions) params() []string {
+	var params []string
 	if copts.clientNoContextTakeover {
-		s += "; client_no_context_takeover"
+		params = append(params, "client_no_context_takeover")
 	}
 	if copts.serverNoContextTakeover {
-		s += "; server_no_context_takeover"
+		params = append(params, "server_no_context_takeover")
+	}
+	if copts.clientMaxWindowBits < maxWindowBits {
+		params = append(params, fmt.Sprintf("client_max_window_bits=%d", copts.clientMaxWindowBits))
+	}
+	if copts.serverMaxWindowBits < maxWindowBits || copts.serverMaxWindowBitsOffered {
+		params = append(params, fmt.Sprintf("server_max_window_bits=%d", copts.serverMaxWindowBits))
+	}
+	if copts.dictionaryID != 0 {
+		// A private parameter so only peers using this package negotiate it.
+		params = append(params, fmt.Sprintf("x_dictionary_id=%d", copts.dictionaryID))
+	}
+	return params
+}
+
+// dictionaryID returns the id of a preset dictionary.
+func dictionaryID(dict []byte) uint32 {
+	if len(dict) == 0 {
+		return 0
+	}
+	id := adler32.Checksum(dict)
+	if id == 0 {
+		id = 1
+	}
+	return id
+}
+
+// deflateExtension implements permessage-deflate.
+// See https://tools.ietf.org/html/rfc7692
+type deflateExtension struct {
+	mode       CompressionMode
+	threshold  int
+	predicate  func(MessageType, int) bool
+	adaptive   bool
+	windowBits int
+	level      int
+	dictSize   int
+	budget     *CompressionBudget
+	// dict is the preset dictionary.
+	dict []byte
+}
+
+var _ Extension = deflateExtension{}
+
+func (e deflateExtension) Name() string {
+	return "permessage-deflate"
+}
+
+func (e deflateExtension) maxWindowBits() int {
+	if e.windowBits == 0 {
+		return maxWindowBits
+	}
+	return e.windowBits
+}
+
+func (e deflateExtension) opts() *compressionOptions {
+	copts := e.mode.opts()
+	copts.clientMaxWindowBits = e.maxWindowBits()
+	copts.serverMaxWindowBits = e.maxWindowBits()
+	copts.dictionaryID = dictionaryID(e.dict)
+	return copts
+}
+
+func (e deflateExtension) Offer() []string {
+	params := e.opts().params()
+	if e.maxWindowBits() == maxWindowBits {
+		// Allow the server to limit our window.
+		params = append(params, "client_max_window_bits")
+	}
+	return params
+}
+
+// Accept declines offers with unknown, invalid or repeated parameters as
+// required by RFC 7692 so that the client's next offer may be accepted.
+// See https://tools.ietf.org/html/rfc7692#section-5.1
+func (e deflateExtension) Accept(params []string) (ExtensionConn, []string, error) {
+	copts := e.mode.opts()
+
+	clientWindowBits := -1
+	var names []string
+	for _, p := range params {
+		name, value := splitExtensionParam(p)
+		if containsFold(names, name) {
+			return nil, nil, nil
+		}
+		names = append(names, name)
+
+		var err error
+		switch name {
+		case "client_no_context_takeover":
+			copts.clientNoContextTakeover = true
+			err = noParamValue(value)
+		case "server_no_context_takeover":
+			copts.serverNoContextTakeover = true
+			err = noParamValue(value)
+		case "client_max_window_bits":
+			// The client supports limiting its window and
+			// may hint at the size it will use.
+			clientWindowBits = maxWindowBits
+			if value != "" {
+				clientWindowBits, err = parseWindowBits(value)
+			}
+		case "server_max_window_bits":
+			copts.serverMaxWindowBits, err = parseWindowBits(value)
+			copts.serverMaxWindowBitsOffered = true
+		case "x_dictionary_id":
+			var id uint32
+			id, err = parseDictionaryID(value)
+			// Only use the dictionary if the client has the same.
+			if err == nil && id == dictionaryID(e.dict) {
+				copts.dictionaryID = id
+			}
+		default:
+			return nil, nil, nil
+		}
+		if err != nil {
+			return nil, nil, nil
+		}
+	}
+
+	// We can always compress with a smaller window than requested but can
+	// only ask the client to do the same if it supports client_max_window_bits.
+	copts.serverMaxWindowBits = minInt(copts.serverMaxWindowBits, e.maxWindowBits())
+	if clientWindowBits != -1 {
+		copts.clientMaxWindowBits = minInt(clientWindowBits, e.maxWindowBits())
+	}
+
+	dc := e.newConn(copts, false)
+	if !dc.reserve() {
+		// The budget cannot afford the sliding windows of context takeover.
+		copts.clientNoContextTakeover = true
+		copts.serverNoContextTakeover = true
+		dc = e.newConn(copts, false)
+	}
+	return dc, copts.params(), nil
+}
+
+func (e deflateExtension) Negotiated(params []string) (ExtensionConn, error) {
+	copts := e.mode.opts()
+	copts.clientMaxWindowBits = e.maxWindowBits()
+
+	serverWindowBits := false
+	for _, p := range params {
+		name, value := splitExtensionParam(p)
+		var err error
+		switch name {
+		case "client_no_context_takeover":
+			copts.clientNoContextTakeover = true
+		case "server_no_context_takeover":
+			copts.serverNoContextTakeover = true
+		case "client_max_window_bits":
+			var bits int
+			bits, err = parseWindowBits(value)
+			copts.clientMaxWindowBits = minInt(bits, copts.clientMaxWindowBits)
+		case "server_max_window_bits":
+			copts.serverMaxWindowBits, err = parseWindowBits(value)
+			if err == nil && copts.serverMaxWindowBits > e.maxWindowBits() {
+				err = errors.New("unexpected")
+			}
+			serverWindowBits = true
+		case "x_dictionary_id":
+			copts.dictionaryID, err = parseDictionaryID(value)
+			if err == nil && copts.dictionaryID != dictionaryID(e.dict) {
+				err = errors.New("unexpected")
+			}
+		default:
+			err = errors.New("unsupported")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v permessage-deflate parameter: %q", err, p)
+		}
+	}
+
+	// The server must accept server_max_window_bits if offered.
+	// See https://tools.ietf.org/html/rfc7692#section-7.1.2.1
+	if e.maxWindowBits() < maxWindowBits && !serverWindowBits {
+		return nil, errors.New("server did not accept permessage-deflate parameter server_max_window_bits")
+	}
+
+	return e.newConn(copts, true), nil
+}
+
+func splitExtensionParam(p string) (name, value string) {
+	i := strings.IndexByte(p, '=')
+	if i == -1 {
+		return p, ""
+	}
+	name = strings.TrimSpace(p[:i])
+	value = strings.TrimSpace(p[i+1:])
+	// Values may be quoted strings.
+	// See https://tools.ietf.org/html/rfc6455#section-9.1
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	return name, value
+}
+
+func noParamValue(s string) error {
+	if s != "" {
+		return errors.New("invalid")
+	}
+	return nil
+}
+
+func parseWindowBits(s string) (int, error) {
+	bits, err := strconv.Atoi(s)
+	if err != nil || bits < minWindowBits || bits > maxWindowBits || s[0] == '0' || s[0] == '+' {
+		return 0, errors.New("invalid")
+	}
+	return bits, nil
+}
+
+func parseDictionaryID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || id == 0 || s[0] == '0' {
+		return 0, errors.New("invalid")
+	}
+	return uint32(id), nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// deflateConn is the permessage-deflate state of a connection.
+type deflateConn struct {
+	compressionOptions
+	client    bool
+	threshold int
+	predicate func(MessageType, int) bool
+
+	fr deflateReader
+	fw deflateWriter
+
+	// dict is the negotiated preset dictionary. With context takeover,
+	// only the first compressed message is primed with it.
+	dict   []byte
+	primed bool
+
+	// The sliding windows are reserved from budget if set.
+	budget *CompressionBudget
+	// mu guards the fields below and the windows of fr and fw
+	// while they may be released by the idle timer.
+	mu        sync.Mutex
+	closed    bool
+	reading   bool
+	lastRead  time.Time
+	lastWrite time.Time
+	idleTimer *time.Timer
+	// readCost and writeCost are the bytes reserved from budget.
+	readCost  int64
+	writeCost int64
+	// readReleased is set while the window of fr is released.
+	readReleased bool
+}
+
+var _ MessageTransformer = &deflateConn{}
+var _ messageCompressor = &deflateConn{}
+
+func (e deflateExtension) newConn(copts *compressionOptions, client bool) *deflateConn {
+	dc := &deflateConn{
+		compressionOptions: *copts,
+		client:             client,
+		threshold:          e.threshold,
+		predicate:          e.predicate,
+	}
+	if copts.dictionaryID != 0 {
+		dc.dict = e.dict
+	}
+	if dc.threshold == 0 {
+		dc.threshold = 128
+		if !dc.writeContextTakeover() {
+			dc.threshold = 512
+		}
+		if dc.dict != nil {
+			dc.threshold = 32
+		}
+	}
+	dc.fw.level = e.level
+	dc.fw.dictSize = e.dictSize
+	if dc.dict != nil && e.level == 0 {
+		// flate.Writer only finds matches in flushes of at least 128 bytes
+		// so compress statelessly to make the most of the dictionary.
+		dc.fw.stateless = true
+	}
+	dc.budget = e.budget
+	if dc.budget != nil {
+		dc.fr.onEOF = dc.read
+		if dc.fw.dictSize == 0 {
+			// Only the dictionary is reserved from the budget so a
+			// flate.Writer must not be kept between messages.
+			dc.fw.dictSize = 1 << maxWindowBits
+		}
+	}
+	if e.adaptive {
+		dc.fw.adaptive = &adaptiveCompressor{}
+	}
+	return dc
+}
+
+func (dc *deflateConn) writeContextTakeover() bool {
+	if dc.client {
+		return !dc.clientNoContextTakeover
+	}
+	return !dc.serverNoContextTakeover
+}
+
+func (dc *deflateConn) readContextTakeover() bool {
+	if dc.client {
+		return !dc.serverNoContextTakeover
+	}
+	return !dc.clientNoContextTakeover
+}
+
+func (dc *deflateConn) writeWindowBits() int {
+	if dc.client {
+		return dc.clientMaxWindowBits
+	}
+	return dc.serverMaxWindowBits
+}
+
+func (dc *deflateConn) readWindowBits() int {
+	if dc.client {
+		return dc.serverMaxWindowBits
+	}
+	return dc.clientMaxWindowBits
+}
+
+// initConn reports the negotiated parameters in the handshake info of c.
+func (dc *deflateConn) initConn(c *Conn) {
+	c.handshake.Compression = dc.info()
+}
+
+func (dc *deflateConn) RSV() RSV {
+	return RSV1
+}
+
+func (dc *deflateConn) Close() error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if dc.closed {
+		return nil
+	}
+	dc.closed = true
+	if dc.idleTimer != nil {
+		dc.idleTimer.Stop()
+	}
+	dc.fr.close()
+	dc.fw.close()
+	dc.fr.snapshot = nil
+	if dc.budget != nil {
+		dc.budget.release(dc.readCost + dc.writeCost)
+	}
+	return nil
+}
+
+// reserve reserves the sliding windows of context takeover from the budget.
+// The window to compress with costs only the dictionary kept of it.
+func (dc *deflateConn) reserve() bool {
+	if dc.budget == nil {
+		return true
+	}
+	if dc.readContextTakeover() {
+		dc.readCost = 1 << dc.readWindowBits()
+	}
+	if dc.writeContextTakeover() {
+		dc.writeCost = int64(dc.fw.dictCap(dc.writeWindowBits()))
+	}
+	if !dc.budget.reserve(dc.readCost + dc.writeCost) {
+		dc.readCost = 0
+		dc.writeCost = 0
+		return false
+	}
+	if dc.readCost+dc.writeCost > 0 {
+		dc.lastRead = time.Now()
+		dc.lastWrite = dc.lastRead
+		dc.armIdleTimer(dc.budget.IdleTimeout)
+	}
+	return true
+}
+
+// reserveWrite reserves the sliding window for writing again
+// if it was released while idle.
+func (dc *deflateConn) reserveWrite() bool {
+	if dc.writeCost > 0 {
+		return true
+	}
+	cost := int64(dc.fw.dictCap(dc.writeWindowBits()))
+	if !dc.budget.reserve(cost) {
+		return false
+	}
+	dc.writeCost = cost
+	dc.armIdleTimer(dc.budget.IdleTimeout)
+	return true
+}
+
+// resumeRead restores the sliding window for reading if it was released
+// while idle. It is reserved even beyond the budget as the peer may
+// reference it.
+func (dc *deflateConn) resumeRead() error {
+	if !dc.readReleased {
+		return nil
+	}
+	dc.readReleased = false
+	dc.budget.release(dc.readCost)
+	dc.readCost = 1 << dc.readWindowBits()
+	dc.budget.take(dc.readCost)
+	dc.armIdleTimer(dc.budget.IdleTimeout)
+	return dc.fr.resume(dc.readWindowBits())
+}
+
+func (dc *deflateConn) armIdleTimer(d time.Duration) {
+	if dc.budget.IdleTimeout <= 0 {
+		return
+	}
+	if dc.idleTimer == nil {
+		dc.idleTimer = time.AfterFunc(d, dc.releaseIdle)
+		return
+	}
+	dc.idleTimer.Reset(d)
+}
+
+// releaseIdle releases the sliding windows not used for the idle timeout.
+//
+// The window for writing is released even while a message is written as
+// the rest of it is then compressed without referencing what came before.
+// The window for reading is kept compressed instead as the peer may still
+// reference it.
+func (dc *deflateConn) releaseIdle() {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if dc.closed {
+		return
+	}
+
+	timeout := dc.budget.IdleTimeout
+	next := timeout
+	if dc.writeCost > 0 {
+		idle := time.Since(dc.lastWrite)
+		if idle >= timeout {
+			dc.fw.dict.close()
+			dc.budget.release(dc.writeCost)
+			dc.writeCost = 0
+		} else {
+			next = timeout - idle
+		}
+	}
+	if dc.readCost > 0 && !dc.readReleased {
+		idle := time.Since(dc.lastRead)
+		if !dc.reading && idle >= timeout {
+			dc.fr.suspend()
+			dc.budget.release(dc.readCost)
+			dc.readCost = int64(cap(dc.fr.snapshot))
+			dc.budget.take(dc.readCost)
+			dc.readReleased = true
+		} else if idle < timeout && timeout-idle < next {
+			next = timeout - idle
+		}
+	}
+	if dc.writeCost > 0 || dc.readCost > 0 && !dc.readReleased {
+		dc.armIdleTimer(next)
+	}
+}
+
+func (dc *deflateConn) WriteMessage(w io.Writer, typ MessageType, sizeHint int) (io.WriteCloser, RSV, error) {
+	if !dc.compressible(typ, sizeHint) {
+		return nil, 0, nil
+	}
+	return dc.compressMessage(w, typ)
+}
+
+func (dc *deflateConn) compressible(typ MessageType, size int) bool {
+	if dc.predicate != nil {
+		return dc.predicate(typ, size)
+	}
+	// Only compresses if the first write crosses the threshold.
+	return size >= dc.threshold
+}
+
+func (dc *deflateConn) shouldCompress(typ MessageType, p []byte) bool {
+	if !dc.compressible(typ, len(p)) {
+		return false
+	}
+	if dc.fw.adaptive != nil {
+		return dc.fw.adaptive.shouldCompress(p)
+	}
+	return true
+}
+
+func (dc *deflateConn) compressMessage(w io.Writer, typ MessageType) (io.WriteCloser, RSV, error) {
+	if dc.budget != nil && dc.writeContextTakeover() {
+		dc.mu.Lock()
+		defer dc.mu.Unlock()
+
+		dc.lastWrite = time.Now()
+		// Without the sliding window, the message is compressed
+		// without referencing previous messages.
+		dc.resetWriter(w, dc.reserveWrite())
+		return budgetWriter{dc: dc}, RSV1, nil
+	}
+	dc.resetWriter(w, dc.writeContextTakeover())
+	return &dc.fw, RSV1, nil
+}
+
+func (dc *deflateConn) resetWriter(w io.Writer, contextTakeover bool) {
+	// Once primed, the window of the peer holds the dictionary even if the
+	// window to compress with is released.
+	var dict []byte
+	if !dc.writeContextTakeover() || !dc.primed {
+		dict = dc.dict
+		dc.primed = true
+	}
+	dc.fw.reset(w, contextTakeover, dc.writeWindowBits(), dict)
+}
+
+// budgetWriter writes a message with the sliding window reserved from the
+// budget. It records the last write so that an idle writer does not keep
+// the window reserved.
+type budgetWriter struct {
+	dc *deflateConn
+}
+
+func (bw budgetWriter) Write(p []byte) (int, error) {
+	bw.dc.mu.Lock()
+	defer bw.dc.mu.Unlock()
+	bw.dc.lastWrite = time.Now()
+	return bw.dc.fw.Write(p)
+}
+
+func (bw budgetWriter) Close() error {
+	bw.dc.mu.Lock()
+	defer bw.dc.mu.Unlock()
+	bw.dc.lastWrite = time.Now()
+	return bw.dc.fw.Close()
+}
+
+func (dc *deflateConn) ReadMessage(r io.Reader, typ MessageType, rsv RSV) (io.Reader, error) {
+	if dc.budget != nil && dc.readContextTakeover() {
+		err := dc.startRead(rsv&RSV1 != 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rsv&RSV1 == 0 {
+		return r, nil
+	}
+	dc.fr.reset(r, dc.readContextTakeover(), dc.readWindowBits(), dc.dict)
+	return &dc.fr, nil
+}
+
+// startRead is called for every message read. A compressed message
+// that was not read to EOF is skipped by the next message so reading is
+// cleared unless the next message is compressed as well.
+func (dc *deflateConn) startRead(compressed bool) error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	dc.reading = compressed
+	if !compressed {
+		return nil
+	}
+	dc.lastRead = time.Now()
+	return dc.resumeRead()
+}
+
+// read is called once a compressed message is read.
+func (dc *deflateConn) read() {
+	dc.mu.Lock()
+	dc.reading = false
+	dc.lastRead = time.Now()
+	dc.mu.Unlock()
+}
+
+type deflateWriter struct {
+	trimWriter      trimLastFourBytesWriter
+	counter         countWriter
+	dict            slidingWindow
+	contextTakeover bool
+	// chunk is the most compressed at once to keep
+	// back references within the window.
+	chunk int
+
+	// level is the flate compression level or 0 for the default.
+	level    int
+	dictSize int
+	fw       *flate.Writer
+	// stream is set when fw compresses the entire message rather
+	// than every chunk being compressed with the dictionary.
+	stream bool
+	// stateless is set to compress chunks with flate.StatelessDeflate
+	// rather than a pooled flate.Writer with the default level.
+	stateless bool
+
+	// adaptive is updated with the ratio every message is
+	// compressed with if set.
+	adaptive *adaptiveCompressor
+	n        int
+}
+
+// maxStatelessDict is the most of the dictionary flate.StatelessDeflate uses.
+const maxStatelessDict = 8192
+
+// writerLevel returns the level of fw.
+func (fw *deflateWriter) writerLevel() int {
+	if fw.level == 0 {
+		return flate.BestSpeed
+	}
+	return fw.level
+}
+
+// dictCap returns the size of the dictionary of previous messages
+// kept to compress with a window of windowBits.
+func (fw *deflateWriter) dictCap(windowBits int) int {
+	dictSize := fw.dictSize
+	if dictSize == 0 {
+		dictSize = maxStatelessDict
+	}
+	if fw.level == 0 {
+		dictSize = minInt(dictSize, maxStatelessDict)
+	}
+	if windowBits < maxWindowBits {
+		// Every chunk is compressed with only the dictionary before it so
+		// splitting the window between them keeps matches within it.
+		dictSize = minInt(dictSize, 1<<windowBits/2)
+	}
+	return dictSize
+}
+
+// reset prepares fw to compress a message into w.
+// If dict is set, the window is primed with it.
+func (fw *deflateWriter) reset(w io.Writer, contextTakeover bool, windowBits int, dict []byte) {
+	fw.counter.w = w
+	fw.counter.n = 0
+	fw.trimWriter.w = &fw.counter
+	fw.trimWriter.reset()
+	fw.contextTakeover = contextTakeover
+	fw.n = 0
+
+	// A flate.Writer references its entire 32 KiB window so it can only stream
+	// messages with the largest window. With context takeover, it is kept
+	// for the lifetime of the connection unless the dictionary size is set
+	// to bound the memory held between messages. Then every chunk is
+	// compressed with only the dictionary before it instead.
+	if contextTakeover {
+		fw.stream = windowBits == maxWindowBits && fw.dictSize == 0 && !fw.stateless
+	} else {
+		fw.stream = windowBits == maxWindowBits && fw.level != 0
+	}
+	if fw.stream {
+		if fw.fw == nil {
+			fw.fw = getFlateWriter(fw.writerLevel())
+			fw.fw.ResetDict(&fw.trimWriter, dict)
+		}
+		return
+	}
+
+	dictSize := fw.dictCap(windowBits)
+	fw.chunk = 0
+	if windowBits < maxWindowBits {
+		fw.chunk = 1<<windowBits - dictSize
+	}
+	if cap(fw.dict.buf) != dictSize {
+		fw.dict.close()
+	}
+	fw.dict.init(dictSize)
+	if dict != nil {
+		fw.dict.write(dict)
+	}
+
+	// With context takeover, a pooled flate.Writer compresses the message
+	// as flate.StatelessDeflate allocates over 256 KiB for every chunk.
+	if fw.fw == nil && (fw.level != 0 || contextTakeover && !fw.stateless) {
+		fw.fw = getFlateWriter(fw.writerLevel())
+	}
+}
+
+func (fw *deflateWriter) Write(p []byte) (int, error) {
+	fw.n += len(p)
+	if fw.stream {
+		return fw.fw.Write(p)
+	}
+
+	n := 0
+	for len(p) > 0 {
+		in := p
+		if fw.chunk > 0 && len(in) > fw.chunk {
+			in = in[:fw.chunk]
+		}
+		p = p[len(in):]
+
+		err := fw.deflate(in)
+		if err != nil {
+			return n, err
+		}
+		fw.dict.write(in)
+		n += len(in)
+	}
+	return n, nil
+}
+
+// deflate compresses p with the dictionary and flushes it.
+func (fw *deflateWriter) deflate(p []byte) error {
+	if fw.fw == nil {
+		return flate.StatelessDeflate(&fw.trimWriter, p, false, fw.dict.buf)
+	}
+
+	fw.fw.ResetDict(&fw.trimWriter, fw.dict.buf)
+	_, err := fw.fw.Write(p)
+	if err != nil {
+		return err
+	}
+	return fw.fw.Flush()
+}
+
+func (fw *deflateWriter) Close() error {
+	if fw.stream {
+		// The sync flush ends with deflateMessageTail which trimWriter removes.
+		err := fw.fw.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	if fw.adaptive != nil {
+		fw.adaptive.observe(fw.n, fw.counter.n)
+	}
+	if fw.stream && fw.contextTakeover {
+		return nil
+	}
+
+	if fw.fw != nil {
+		putFlateWriter(fw.writerLevel(), fw.fw)
+		fw.fw = nil
+	}
+	if !fw.contextTakeover {
+		fw.dict.close()
+	}
+	return nil
+}
+
+func (fw *deflateWriter) close() {
+	if fw.fw != nil {
+		putFlateWriter(fw.writerLevel(), fw.fw)
+		fw.fw = nil
+	}
+	fw.dict.close()
+}
+
+type deflateReader struct {
+	src     io.Reader
+	srcEOF  bool
+	tail    strings.Reader
+	srcFunc readerFunc
+
+	br              *bufio.Reader
+	fr              io.Reader
+	dict            slidingWindow
+	contextTakeover bool
+
+	// snapshot holds dict compressed while it is released.
+	snapshot []byte
+	// onEOF is called once a message is read if set.
+	onEOF func()
+}
+
+// reset prepares fr to decompress a message from r.
+// If dict is set, the window is primed with it.
+func (fr *deflateReader) reset(r io.Reader, contextTakeover bool, windowBits int, dict []byte) {
+	if fr.fr != nil {
+		// The previous message was not read to EOF.
+		putFlateReader(fr.fr)
+	}
+	fr.src = r
+	fr.srcEOF = false
+	fr.tail.Reset(deflateMessageTail)
+	fr.contextTakeover = contextTakeover
+
+	if fr.contextTakeover && fr.dict.buf == nil {
+		// The peer cannot reference further back than its window.
+		fr.dict.init(1 << windowBits)
+		fr.dict.write(dict)
+	}
+	if fr.br == nil {
+		fr.srcFunc = fr.readSrc
+		fr.br = getBufioReader(fr.srcFunc)
+	}
+	fr.br.Reset(fr.srcFunc)
+
+	if fr.contextTakeover {
+		dict = fr.dict.buf
+	}
+	fr.fr = getFlateReader(fr.br, dict)
+}
+
+// readSrc reads the message followed by deflateMessageTail.
+func (fr *deflateReader) readSrc(p []byte) (int, error) {
+	if !fr.srcEOF {
+		n, err := fr.src.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		fr.srcEOF = true
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return fr.tail.Read(p)
+}
+
+func (fr *deflateReader) Read(p []byte) (int, error) {
+	if fr.fr == nil {
+		return 0, io.EOF
+	}
+
+	n, err := fr.fr.Read(p)
+	if fr.contextTakeover {
+		fr.dict.write(p[:n])
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) && fr.srcEOF {
+		putFlateReader(fr.fr)
+		fr.fr = nil
+		if fr.onEOF != nil {
+			fr.onEOF()
+		}
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// suspend compresses the window into snapshot and releases it.
+func (fr *deflateReader) suspend() {
+	if fr.fr != nil {
+		// The message was skipped before EOF.
+		putFlateReader(fr.fr)
+		fr.fr = nil
+	}
+	if fr.dict.buf != nil {
+		var buf bytes.Buffer
+		fw := getFlateWriter(flate.BestSpeed)
+		fw.Reset(&buf)
+		// Writes to a bytes.Buffer cannot fail.
+		fw.Write(fr.dict.buf)
+		fw.Close()
+		putFlateWriter(flate.BestSpeed, fw)
+		fr.snapshot = buf.Bytes()
+		fr.dict.close()
+	}
+	if fr.br != nil {
+		putBufioReader(fr.br)
+		fr.br = nil
+	}
+}
+
+// resume restores the window from snapshot.
+func (fr *deflateReader) resume(windowBits int) error {
+	if fr.snapshot == nil {
+		return nil
+	}
+	fr.dict.init(1 << windowBits)
+	r := getFlateReader(bytes.NewReader(fr.snapshot), nil)
+	defer putFlateReader(r)
+	n, err := io.ReadFull(r, fr.dict.buf[:cap(fr.dict.buf)])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("failed to restore sliding window: %w", err)
+	}
+	fr.dict.buf = fr.dict.buf[:n]
+	fr.snapshot = nil
+	return nil
+}
+
+func (fr *deflateReader) close() {
+	if fr.fr != nil {
+		putFlateReader(fr.fr)
+		fr.fr = nil
+	}
+	fr.dict.close()
+	if fr.br != nil {
+		putBufioReader(fr.br)
+		fr.br = nil
 	}
-	h.Set("Sec-WebSocket-Extensions", s)
 }
 
 // These bytes are required to get flate.Reader to return.
@@ -93,6 +1062,18 @@ func (tw *trimLastFourBytesWriter) Write(p []byte) (int, error) {
 	return n + 4, err
 }
 
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err
+}
+
 var flateReaderPool sync.Pool
 
 func getFlateReader(r io.Reader, dict []byte) io.Reader {
@@ -108,6 +1089,25 @@ func putFlateReader(fr io.Reader) {
 	flateReaderPool.Put(fr)
 }
 
+// flateWriterPools holds a pool of flate.Writer for every level
+// from flate.HuffmanOnly to flate.BestCompression.
+var flateWriterPools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+func getFlateWriter(level int) *flate.Writer {
+	fw, ok := flateWriterPools[level-flate.HuffmanOnly].Get().(*flate.Writer)
+	if !ok {
+		// The level has been verified.
+		fw, _ = flate.NewWriter(nil, level)
+	}
+	return fw
+}
+
+func putFlateWriter(level int, fw *flate.Writer) {
+	// Drop the references to the dictionary and destination.
+	fw.ResetDict(nil, nil)
+	flateWriterPools[level-flate.HuffmanOnly].Put(fw)
+}
+
 type slidingWindow struct {
 	buf []byte
 }
@@ -179,3 +1179,102 @@ func (sw *slidingWindow) write(p []byte) {
 
 	sw.buf = append(sw.buf, p...)
 }
+
+// adaptiveCompressor stops compressing messages when it does not pay off
+// as judged by the ratio recent messages were compressed with and the
+// entropy of the first write of a message.
+type adaptiveCompressor struct {
+	// ratio is the moving average of the compressed size
+	// of messages over their uncompressed size.
+	ratio float64
+	// threshold is the size under which messages are only compressed
+	// if their entropy is low. It rises as messages compress poorly.
+	threshold int
+	// skip is the number of messages left to write uncompressed
+	// unless their entropy suggests they will compress well.
+	skip    int
+	backoff int
+}
+
+const (
+	// adaptiveMaxRatio is the largest compression ratio considered worthwhile.
+	adaptiveMaxRatio = 0.9
+	// adaptiveMaxBackoff is the most messages skipped in a row.
+	adaptiveMaxBackoff = 64
+	// adaptiveMaxThreshold is the most the threshold rises.
+	adaptiveMaxThreshold = 4096
+	// adaptiveSampleSize is the most bytes of a message sampled for its entropy.
+	adaptiveSampleSize = 1024
+	// Entropies are in bits per byte. Random data sampled with adaptiveSampleSize
+	// has about 7.8 while text has about 5.
+	adaptiveRandomEntropy       = 7
+	adaptiveCompressibleEntropy = 5.5
+)
+
+func (ac *adaptiveCompressor) shouldCompress(p []byte) bool {
+	e := entropy(p)
+	if ac.skip > 0 || len(p) < ac.threshold {
+		if ac.skip > 0 {
+			ac.skip--
+		}
+		if e > adaptiveCompressibleEntropy {
+			return false
+		}
+		// The messages seem to have changed so try again.
+		ac.skip = 0
+		return true
+	}
+	// Do not bother compressing data that looks random.
+	return e < adaptiveRandomEntropy
+}
+
+func (ac *adaptiveCompressor) observe(n, compressed int) {
+	if n == 0 {
+		return
+	}
+
+	r := float64(compressed) / float64(n)
+	if ac.ratio == 0 {
+		ac.ratio = r
+	} else {
+		ac.ratio = ac.ratio*0.75 + r*0.25
+	}
+
+	if ac.ratio > adaptiveMaxRatio {
+		ac.backoff = minInt(2*ac.backoff+1, adaptiveMaxBackoff)
+		ac.skip = ac.backoff
+		ac.threshold = minInt(n+1, adaptiveMaxThreshold)
+		// Give the next message a fresh chance.
+		ac.ratio = 0
+		return
+	}
+
+	ac.backoff = 0
+	ac.threshold /= 2
+}
+
+// entropy returns the Shannon entropy in bits per byte of
+// up to adaptiveSampleSize bytes of p.
+func entropy(p []byte) float64 {
+	if len(p) > adaptiveSampleSize {
+		p = p[:adaptiveSampleSize]
+	}
+	if len(p) == 0 {
+		return 0
+	}
+
+	var counts [256]int
+	for _, b := range p {
+		counts[b]++
+	}
+
+	var e float64
+	n := float64(len(p))
+	for _, c := range counts {
+		if c > 0 {
+			f := float64(c) / n
+			e -= f * math.Log2(f)
+		}
+	}
+	return e
+}
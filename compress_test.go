@@ -3,8 +3,15 @@
 package websocket
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/klauspost/compress/flate"
 
 	"nhooyr.io/websocket/internal/test/assert"
 	"nhooyr.io/websocket/internal/test/xrand"
@@ -32,3 +39,359 @@ func Test_slidingWindow(t *testing.T) {
 		})
 	}
 }
+
+func Test_deflateConn(t *testing.T) {
+	t.Parallel()
+
+	for level := flate.HuffmanOnly; level <= flate.BestCompression; level++ {
+		for _, mode := range []CompressionMode{CompressionContextTakeover, CompressionNoContextTakeover} {
+			for _, stream := range []bool{true, false} {
+				e := deflateExtension{
+					mode:       mode,
+					threshold:  1,
+					windowBits: maxWindowBits,
+					level:      level,
+				}
+				if !stream {
+					e.windowBits = minWindowBits + xrand.Int(maxWindowBits-minWindowBits+1)
+					e.dictSize = 1 + xrand.Int(maxDictionarySize)
+				}
+				t.Run(fmt.Sprintf("%v/%v/%v", level, mode, stream), func(t *testing.T) {
+					t.Parallel()
+					testDeflateConn(t, e)
+				})
+			}
+		}
+	}
+}
+
+func testDeflateConn(t *testing.T, e deflateExtension) {
+	copts := e.opts()
+	client := e.newConn(copts, true)
+	defer client.Close()
+	server := e.newConn(copts, false)
+	defer server.Close()
+
+	for i := 0; i < 10; i++ {
+		msg := strings.Repeat(xrand.String(1+xrand.Int(128)), 1+xrand.Int(512))
+
+		var buf bytes.Buffer
+		w, rsv, err := client.WriteMessage(&buf, MessageText, len(msg))
+		assert.Success(t, err)
+		for p := msg; len(p) > 0; {
+			n := 1 + xrand.Int(len(p))
+			_, err = w.Write([]byte(p[:n]))
+			assert.Success(t, err)
+			p = p[n:]
+		}
+		err = w.Close()
+		assert.Success(t, err)
+
+		r, err := server.ReadMessage(&buf, MessageText, rsv)
+		assert.Success(t, err)
+		b, err := ioutil.ReadAll(r)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", msg, string(b))
+	}
+}
+
+func Test_deflateConnPresetDictionary(t *testing.T) {
+	t.Parallel()
+
+	dict := []byte(`{"type":"update","status":"online","user":`)
+	for _, mode := range []CompressionMode{CompressionContextTakeover, CompressionNoContextTakeover} {
+		for _, level := range []int{0, flate.BestCompression} {
+			e := deflateExtension{
+				mode:      mode,
+				threshold: 1,
+				level:     level,
+				dict:      dict,
+			}
+			t.Run(fmt.Sprintf("%v/%v", mode, level), func(t *testing.T) {
+				t.Parallel()
+				testDeflateConn(t, e)
+
+				copts := e.opts()
+				client := e.newConn(copts, true)
+				defer client.Close()
+
+				// Even a small message compresses well from the start.
+				msg := `{"type":"update","status":"online","user":"meow"}`
+				var buf bytes.Buffer
+				w, _, err := client.WriteMessage(&buf, MessageText, len(msg))
+				assert.Success(t, err)
+				_, err = w.Write([]byte(msg))
+				assert.Success(t, err)
+				err = w.Close()
+				assert.Success(t, err)
+				if buf.Len() > len(msg)/2 {
+					t.Fatalf("message compressed poorly: %v of %v bytes", buf.Len(), len(msg))
+				}
+			})
+		}
+	}
+}
+
+func Test_adaptiveCompressor(t *testing.T) {
+	t.Parallel()
+
+	text := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 50))
+	random := xrand.Bytes(2048)
+	// Has an entropy between that of text and random data.
+	mixed := xrand.Bytes(2048)
+	for i := range mixed {
+		mixed[i] &= 0x3f
+	}
+
+	var ac adaptiveCompressor
+	assert.Equal(t, "text", true, ac.shouldCompress(text))
+	assert.Equal(t, "random", false, ac.shouldCompress(random))
+	assert.Equal(t, "mixed", true, ac.shouldCompress(mixed))
+
+	ac.observe(len(text), len(text)/10)
+	assert.Equal(t, "backoff", 0, ac.skip)
+
+	// Compressing poorly skips the next message.
+	for i := 0; ac.skip == 0; i++ {
+		if i == 10 {
+			t.Fatal("never backed off")
+		}
+		ac.observe(len(mixed), len(mixed))
+	}
+	assert.Equal(t, "backoff", 1, ac.skip)
+	assert.Equal(t, "threshold", len(mixed)+1, ac.threshold)
+	assert.Equal(t, "mixed", false, ac.shouldCompress(mixed))
+	assert.Equal(t, "mixed", false, ac.shouldCompress(mixed))
+
+	// Larger messages are tried again.
+	large := append(mixed, mixed...)
+	assert.Equal(t, "large", true, ac.shouldCompress(large))
+
+	// Compressing poorly again backs off for longer.
+	ac.observe(len(large), len(large))
+	assert.Equal(t, "backoff", 3, ac.skip)
+	assert.Equal(t, "threshold", adaptiveMaxThreshold, ac.threshold)
+
+	// Until the messages compress well again.
+	assert.Equal(t, "text", true, ac.shouldCompress(text))
+	assert.Equal(t, "backoff", 0, ac.skip)
+	ac.observe(len(text), len(text)/10)
+	assert.Equal(t, "backoff", 0, ac.backoff)
+	assert.Equal(t, "threshold", adaptiveMaxThreshold/2, ac.threshold)
+}
+
+func TestCompressionBudget(t *testing.T) {
+	t.Parallel()
+
+	const window = 1 << maxWindowBits
+	// The window to decompress with and the dictionary to compress with.
+	const cost = window + maxStatelessDict
+	b := &CompressionBudget{
+		Max: cost,
+		// The test releases the windows itself.
+		IdleTimeout: time.Hour,
+	}
+	e := deflateExtension{
+		mode:      CompressionContextTakeover,
+		threshold: 1,
+		budget:    b,
+	}
+
+	ec1, params, err := e.Accept(nil)
+	assert.Success(t, err)
+	defer ec1.Close()
+	assert.Equal(t, "params", []string(nil), params)
+	assert.Equal(t, "used", int64(cost), b.Used())
+
+	// The budget is exhausted so context takeover is declined.
+	ec2, params, err := e.Accept(nil)
+	assert.Success(t, err)
+	defer ec2.Close()
+	assert.Equal(t, "params", []string{"client_no_context_takeover", "server_no_context_takeover"}, params)
+	assert.Equal(t, "used", int64(cost), b.Used())
+
+	server := ec1.(*deflateConn)
+	client := deflateExtension{
+		mode:      CompressionContextTakeover,
+		threshold: 1,
+	}.newConn(&server.compressionOptions, true)
+	defer client.Close()
+
+	msg := strings.Repeat("hello", 100)
+	read := func(dc *deflateConn, p []byte) string {
+		r, err := dc.ReadMessage(bytes.NewReader(p), MessageText, RSV1)
+		assert.Success(t, err)
+		b, err := ioutil.ReadAll(r)
+		assert.Success(t, err)
+		return string(b)
+	}
+	roundTrip := func(from, to *deflateConn) {
+		var buf bytes.Buffer
+		w, _, err := from.compressMessage(&buf, MessageText)
+		assert.Success(t, err)
+		_, err = w.Write([]byte(msg))
+		assert.Success(t, err)
+		err = w.Close()
+		assert.Success(t, err)
+		assert.Equal(t, "msg", msg, read(to, buf.Bytes()))
+	}
+	idle := func() {
+		server.mu.Lock()
+		server.lastRead = time.Time{}
+		server.lastWrite = time.Time{}
+		server.mu.Unlock()
+		server.releaseIdle()
+	}
+
+	roundTrip(client, server)
+	roundTrip(server, client)
+
+	// Both windows are released while idle but the window to
+	// decompress with is kept compressed.
+	idle()
+	if used := b.Used(); used <= 0 || used >= maxStatelessDict {
+		t.Fatalf("unexpected used while idle: %v", used)
+	}
+
+	// The client references the previous message which
+	// must be restored to decompress this one.
+	roundTrip(client, server)
+	assert.Equal(t, "used", int64(window), b.Used())
+
+	// A writer left open does not keep the dictionary.
+	var buf bytes.Buffer
+	w, _, err := server.compressMessage(&buf, MessageText)
+	assert.Success(t, err)
+	assert.Equal(t, "used", int64(cost), b.Used())
+	_, err = w.Write([]byte(msg))
+	assert.Success(t, err)
+	idle()
+	if used := b.Used(); used >= maxStatelessDict {
+		t.Fatalf("unexpected used while idle: %v", used)
+	}
+	_, err = w.Write([]byte(msg))
+	assert.Success(t, err)
+	err = w.Close()
+	assert.Success(t, err)
+	assert.Equal(t, "msg", msg+msg, read(client, buf.Bytes()))
+
+	roundTrip(server, client)
+	roundTrip(client, server)
+	assert.Equal(t, "used", int64(cost), b.Used())
+
+	// A message abandoned partway through is skipped by the next
+	// message and does not keep the window to decompress with.
+	buf.Reset()
+	w, _, err = client.compressMessage(&buf, MessageText)
+	assert.Success(t, err)
+	_, err = w.Write([]byte(msg))
+	assert.Success(t, err)
+	err = w.Close()
+	assert.Success(t, err)
+	r, err := server.ReadMessage(bytes.NewReader(buf.Bytes()), MessageText, RSV1)
+	assert.Success(t, err)
+	_, err = io.ReadFull(r, make([]byte, len(msg)/2))
+	assert.Success(t, err)
+	_, err = server.ReadMessage(strings.NewReader(msg), MessageText, 0)
+	assert.Success(t, err)
+	idle()
+	if used := b.Used(); used <= 0 || used >= maxStatelessDict {
+		t.Fatalf("unexpected used while idle: %v", used)
+	}
+
+	err = ec1.Close()
+	assert.Success(t, err)
+	err = ec2.Close()
+	assert.Success(t, err)
+	assert.Equal(t, "used", int64(0), b.Used())
+}
+
+func BenchmarkDeflate(b *testing.B) {
+	msgs := make([][]byte, 64)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf(`{"id":%d,"type":"update","user":"user%d","status":"online","score":%d,"tags":["a","b","c"]}`, i, i%7, xrand.Int(9999)))
+		for len(msgs[i]) < 512 {
+			msgs[i] = append(msgs[i], msgs[i]...)
+		}
+	}
+
+	benchmarks := []struct {
+		name string
+		e    deflateExtension
+		// stateless compresses every chunk with flate.StatelessDeflate
+		// as context takeover did before a flate.Writer was kept.
+		stateless bool
+	}{
+		{
+			name: "statelessContextTakeover",
+			e: deflateExtension{
+				mode:     CompressionContextTakeover,
+				dictSize: maxStatelessDict,
+			},
+			stateless: true,
+		},
+		{
+			name: "dictionaryContextTakeover",
+			e: deflateExtension{
+				mode:     CompressionContextTakeover,
+				dictSize: maxStatelessDict,
+			},
+		},
+		{
+			name: "streamContextTakeover",
+			e: deflateExtension{
+				mode: CompressionContextTakeover,
+			},
+		},
+		{
+			name: "statelessNoContextTakeover",
+			e: deflateExtension{
+				mode: CompressionNoContextTakeover,
+			},
+		},
+		{
+			name: "streamNoContextTakeover",
+			e: deflateExtension{
+				mode:  CompressionNoContextTakeover,
+				level: flate.BestSpeed,
+			},
+		},
+	}
+	for _, bm := range benchmarks {
+		bm := bm
+		b.Run(bm.name, func(b *testing.B) {
+			bm.e.threshold = 1
+			dc := bm.e.newConn(bm.e.opts(), false)
+			dc.fw.stateless = bm.stateless
+			defer dc.Close()
+
+			var n, compressed int
+			dst := writerFunc(func(p []byte) (int, error) {
+				compressed += len(p)
+				return len(p), nil
+			})
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				msg := msgs[i%len(msgs)]
+				w, _, err := dc.WriteMessage(dst, MessageText, len(msg))
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, err = w.Write(msg)
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = w.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				n += len(msg)
+			}
+
+			b.ReportMetric(float64(compressed)/float64(n), "ratio")
+		})
+	}
+}
@@ -1,5 +1,10 @@
 package websocket
 
+import (
+	"fmt"
+	"time"
+)
+
 // MessageType represents the type of a WebSocket message.
 // See https://tools.ietf.org/html/rfc6455#section-5.6
 type MessageType int
@@ -11,3 +16,77 @@ const (
 	// MessageBinary is for binary messages like protobufs.
 	MessageBinary
 )
+
+// ReadLimit identifies a limit on reading a single message.
+type ReadLimit int
+
+// ReadLimit constants.
+const (
+	// ReadLimitMessage limits the bytes of a message once decompressed.
+	// See Conn.SetReadLimit.
+	ReadLimitMessage ReadLimit = iota
+	// ReadLimitWire limits the payload bytes of a message as received.
+	// See Conn.SetWireReadLimit.
+	ReadLimitWire
+	// ReadLimitExpansion limits the ratio of the bytes of a message once
+	// decompressed to its payload bytes as received.
+	// See Conn.SetReadExpansionLimit.
+	ReadLimitExpansion
+)
+
+// ReadLimitError is returned when a message exceeds a read limit.
+// The connection is closed with StatusMessageTooBig.
+//
+// Use errors.As to check for it.
+type ReadLimitError struct {
+	Limit ReadLimit
+	// Max is the value of the limit.
+	Max int64
+}
+
+func (e ReadLimitError) Error() string {
+	switch e.Limit {
+	case ReadLimitWire:
+		return fmt.Sprintf("wire read limited at %v bytes", e.Max)
+	case ReadLimitExpansion:
+		return fmt.Sprintf("read limited at an expansion ratio of %v", e.Max)
+	default:
+		return fmt.Sprintf("read limited at %v bytes", e.Max)
+	}
+}
+
+// KeepAlive configures pings sent automatically to detect a peer
+// that stopped responding.
+//
+// As with Conn.Ping, the connection must be read from concurrently
+// for pongs to be received.
+type KeepAlive struct {
+	// Interval is how long the connection may go without receiving
+	// a frame from the peer before a ping is sent. Pings are thus
+	// skipped while data is flowing from the peer.
+	Interval time.Duration
+
+	// Timeout bounds how long to wait for the pong to each ping.
+	//
+	// Defaults to Interval.
+	Timeout time.Duration
+
+	// MaxMissed is the number of consecutive pings the peer may fail
+	// to respond to in time before the connection is closed.
+	//
+	// Defaults to 1.
+	MaxMissed int
+}
+
+// KeepAliveError is returned when the peer stops responding to the pings
+// sent by KeepAlive. The connection is closed with StatusGoingAway.
+//
+// Use errors.As to check for it.
+type KeepAliveError struct {
+	// Missed is the number of consecutive pings the peer did not respond to.
+	Missed int
+}
+
+func (e KeepAliveError) Error() string {
+	return fmt.Sprintf("peer did not respond to %v keepalive pings", e.Missed)
+}
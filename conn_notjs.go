@@ -5,13 +5,19 @@ package websocket
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"runtime"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"nhooyr.io/websocket/internal/xsync"
 )
 
 // Conn represents a WebSocket connection.
@@ -26,17 +32,28 @@ import (
 // On any error from any method, the connection is closed
 // with an appropriate reason.
 type Conn struct {
-	subprotocol    string
-	rwc            io.ReadWriteCloser
-	client         bool
-	copts          *compressionOptions
-	flateThreshold int
-	br             *bufio.Reader
-	bw             *bufio.Writer
+	subprotocol string
+	rwc         io.ReadWriteCloser
+	client      bool
+	handshake   HandshakeInfo
+	br          *bufio.Reader
+	bw          *bufio.Writer
+
+	// Negotiated extensions.
+	exts              []ExtensionConn
+	msgTransformers   []MessageTransformer
+	frameTransformers []FrameTransformer
+	frameHandlers     map[opcode]ExtensionConn
+	msgRSV            RSV
+	frameRSV          RSV
 
 	readTimeout  chan context.Context
 	writeTimeout chan context.Context
 
+	controlTimeout time.Duration
+	closeTimeout   time.Duration
+	halfClose      bool
+
 	// Read state.
 	readMu            *mu
 	readHeaderBuf     [8]byte
@@ -55,30 +72,48 @@ type Conn struct {
 	closeMu    sync.Mutex
 	closeErr   error
 	wroteClose bool
+	closeInfo  CloseInfo
 
 	pingCounter   int32
 	activePingsMu sync.Mutex
-	activePings   map[string]chan<- struct{}
+	activePings   map[string]activePing
+	onPing        func([]byte)
+	onPong        func([]byte)
+	// rtt is the smoothed round trip time in nanoseconds.
+	rtt xsync.Int64
+	// readActivity is set when a frame is read and cleared
+	// by keepAliveLoop before each ping.
+	readActivity int32
 }
 
 type connConfig struct {
-	subprotocol    string
-	rwc            io.ReadWriteCloser
-	client         bool
-	copts          *compressionOptions
-	flateThreshold int
+	subprotocol string
+	rwc         io.ReadWriteCloser
+	client      bool
+	exts        []ExtensionConn
+	handshake   HandshakeInfo
+
+	controlTimeout time.Duration
+	closeTimeout   time.Duration
+	keepAlive      *KeepAlive
+	onPing         func([]byte)
+	onPong         func([]byte)
+	halfClose      bool
 
 	br *bufio.Reader
 	bw *bufio.Writer
 }
 
+// defaultTimeout is the default of the ControlTimeout
+// and CloseTimeout options.
+const defaultTimeout = time.Second * 5
+
 func newConn(cfg connConfig) *Conn {
 	c := &Conn{
-		subprotocol:    cfg.subprotocol,
-		rwc:            cfg.rwc,
-		client:         cfg.client,
-		copts:          cfg.copts,
-		flateThreshold: cfg.flateThreshold,
+		subprotocol: cfg.subprotocol,
+		rwc:         cfg.rwc,
+		client:      cfg.client,
+		handshake:   cfg.handshake,
 
 		br: cfg.br,
 		bw: cfg.bw,
@@ -86,10 +121,25 @@ func newConn(cfg connConfig) *Conn {
 		readTimeout:  make(chan context.Context),
 		writeTimeout: make(chan context.Context),
 
+		controlTimeout: cfg.controlTimeout,
+		closeTimeout:   cfg.closeTimeout,
+		halfClose:      cfg.halfClose,
+
 		closed:      make(chan struct{}),
-		activePings: make(map[string]chan<- struct{}),
+		activePings: make(map[string]activePing),
+		onPing:      cfg.onPing,
+		onPong:      cfg.onPong,
 	}
 
+	if c.controlTimeout == 0 {
+		c.controlTimeout = defaultTimeout
+	}
+	if c.closeTimeout == 0 {
+		c.closeTimeout = defaultTimeout
+	}
+
+	c.initExtensions(cfg.exts)
+
 	c.readMu = newMu(c)
 	c.writeFrameMu = newMu(c)
 
@@ -100,18 +150,14 @@ func newConn(cfg connConfig) *Conn {
 		c.writeBuf = extractBufioWriterBuf(c.bw, c.rwc)
 	}
 
-	if c.flate() && c.flateThreshold == 0 {
-		c.flateThreshold = 128
-		if !c.msgWriterState.flateContextTakeover() {
-			c.flateThreshold = 512
-		}
-	}
-
 	runtime.SetFinalizer(c, func(c *Conn) {
 		c.close(errors.New("connection garbage collected"))
 	})
 
 	go c.timeoutLoop()
+	if cfg.keepAlive != nil {
+		go c.keepAliveLoop(*cfg.keepAlive)
+	}
 
 	return c
 }
@@ -122,6 +168,38 @@ func (c *Conn) Subprotocol() string {
 	return c.subprotocol
 }
 
+// HandshakeInfo describes the handshake that established a Conn.
+type HandshakeInfo struct {
+	// RequestHeader holds the headers of the client's handshake request.
+	RequestHeader http.Header
+
+	// ResponseHeader holds the headers of the server's handshake response.
+	ResponseHeader http.Header
+
+	// Compression describes the negotiated permessage-deflate parameters.
+	// It is nil if compression was not negotiated.
+	Compression *CompressionInfo
+
+	// LocalAddr and RemoteAddr are the addresses of the underlying network
+	// connection if known. With HTTP/2 and HTTP/3 it is shared with other streams.
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+
+	// TLS describes the TLS connection the handshake was performed over.
+	// It is nil if TLS was not used.
+	TLS *tls.ConnectionState
+}
+
+// HandshakeInfo returns information about the handshake that established the connection.
+// The returned headers must not be modified.
+func (c *Conn) HandshakeInfo() HandshakeInfo {
+	return c.handshake
+}
+
+func (c *Conn) netAddrs() (local, remote net.Addr) {
+	return c.handshake.LocalAddr, c.handshake.RemoteAddr
+}
+
 func (c *Conn) close(err error) {
 	c.closeMu.Lock()
 	defer c.closeMu.Unlock()
@@ -142,6 +220,8 @@ func (c *Conn) close(err error) {
 		c.msgWriterState.close()
 
 		c.msgReader.close()
+
+		c.closeExtensions()
 	}()
 }
 
@@ -167,39 +247,92 @@ func (c *Conn) timeoutLoop() {
 	}
 }
 
-func (c *Conn) flate() bool {
-	return c.copts != nil
-}
-
 // Ping sends a ping to the peer and waits for a pong.
 // Use this to measure latency or ensure the peer is responsive.
 // Ping must be called concurrently with Reader as it does
 // not read from the connection but instead waits for a Reader call
 // to read the pong.
 //
-// TCP Keepalives should suffice for most use cases.
+// TCP Keepalives should suffice for most use cases. To ping the peer
+// automatically and detect when it stops responding, see KeepAlive.
 func (c *Conn) Ping(ctx context.Context) error {
-	p := atomic.AddInt32(&c.pingCounter, 1)
+	p, pong := c.addCounterPing()
 
-	err := c.ping(ctx, strconv.Itoa(int(p)))
+	err := c.ping(ctx, p, pong)
 	if err != nil {
 		return fmt.Errorf("failed to ping: %w", err)
 	}
 	return nil
 }
 
-func (c *Conn) ping(ctx context.Context, p string) error {
-	pong := make(chan struct{})
+// PingPayload is like Ping but sends the given payload which the peer echoes
+// in its pong. The payload must be at most 125 bytes and must not be in use
+// by a concurrent call, including a ping sent by Ping or KeepAlive.
+func (c *Conn) PingPayload(ctx context.Context, p []byte) error {
+	err := c.pingPayload(ctx, p)
+	if err != nil {
+		return fmt.Errorf("failed to ping: %w", err)
+	}
+	return nil
+}
 
-	c.activePingsMu.Lock()
-	c.activePings[p] = pong
-	c.activePingsMu.Unlock()
+func (c *Conn) pingPayload(ctx context.Context, p []byte) error {
+	if len(p) > maxControlPayload {
+		return fmt.Errorf("payload length %v exceeds the maximum of %v bytes", len(p), maxControlPayload)
+	}
+	pong, ok := c.addActivePing(string(p))
+	if !ok {
+		return fmt.Errorf("ping with payload %q already in flight", p)
+	}
+	return c.ping(ctx, string(p), pong)
+}
 
-	defer func() {
-		c.activePingsMu.Lock()
-		delete(c.activePings, p)
-		c.activePingsMu.Unlock()
-	}()
+// Pong sends an unsolicited pong with the given payload to the peer.
+// It serves as a unidirectional heartbeat and the peer does not respond.
+// The payload must be at most 125 bytes.
+//
+// Pongs in response to pings are always sent automatically.
+func (c *Conn) Pong(ctx context.Context, p []byte) error {
+	err := c.pong(ctx, p)
+	if err != nil {
+		return fmt.Errorf("failed to pong: %w", err)
+	}
+	return nil
+}
+
+func (c *Conn) pong(ctx context.Context, p []byte) error {
+	if len(p) > maxControlPayload {
+		return fmt.Errorf("payload length %v exceeds the maximum of %v bytes", len(p), maxControlPayload)
+	}
+	return c.writeControl(ctx, opPong, p)
+}
+
+// RTT returns the smoothed round trip time to the peer as measured by the
+// pings sent with Ping, PingPayload and KeepAlive. Like TCP's smoothed round
+// trip time, it is an exponentially weighted moving average of the samples.
+//
+// It returns 0 until the first pong is received.
+func (c *Conn) RTT() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
+
+// updateRTT adds a sample to the smoothed round trip time
+// with a weight of 1/8 as in RFC 6298.
+// It is only called by the goroutine reading the connection.
+func (c *Conn) updateRTT(sample time.Duration) {
+	rtt := c.rtt.Load()
+	if rtt == 0 {
+		rtt = int64(sample)
+	} else {
+		rtt += (int64(sample) - rtt) / 8
+	}
+	c.rtt.Store(rtt)
+}
+
+// ping sends a ping with payload p, which must have been added
+// with addActivePing, and waits for pong to be closed.
+func (c *Conn) ping(ctx context.Context, p string, pong <-chan struct{}) error {
+	defer c.removeActivePing(p)
 
 	err := c.writeControl(ctx, opPing, []byte(p))
 	if err != nil {
@@ -218,6 +351,132 @@ func (c *Conn) ping(ctx context.Context, p string) error {
 	}
 }
 
+// activePing is a ping waiting for its pong.
+type activePing struct {
+	pong chan<- struct{}
+	// sent is when the ping was sent to measure the round trip time.
+	sent time.Time
+}
+
+// addActivePing returns a channel that is closed when
+// the pong with payload p is received. It returns false
+// if a ping with payload p is already in flight.
+func (c *Conn) addActivePing(p string) (<-chan struct{}, bool) {
+	c.activePingsMu.Lock()
+	defer c.activePingsMu.Unlock()
+
+	if _, ok := c.activePings[p]; ok {
+		return nil, false
+	}
+	pong := make(chan struct{})
+	c.activePings[p] = activePing{
+		pong: pong,
+		sent: time.Now(),
+	}
+	return pong, true
+}
+
+// addCounterPing adds an active ping for the next value of the ping counter.
+// Values in flight from PingPayload are skipped so the two never share a pong.
+func (c *Conn) addCounterPing() (string, <-chan struct{}) {
+	for {
+		p := strconv.Itoa(int(atomic.AddInt32(&c.pingCounter, 1)))
+		pong, ok := c.addActivePing(p)
+		if ok {
+			return p, pong
+		}
+	}
+}
+
+func (c *Conn) removeActivePing(p string) {
+	c.activePingsMu.Lock()
+	delete(c.activePings, p)
+	c.activePingsMu.Unlock()
+}
+
+func verifyKeepAlive(ka *KeepAlive) error {
+	if ka == nil {
+		return nil
+	}
+	if ka.Interval <= 0 {
+		return fmt.Errorf("KeepAlive.Interval must be positive: %v", ka.Interval)
+	}
+	if ka.Timeout < 0 {
+		return fmt.Errorf("KeepAlive.Timeout cannot be negative: %v", ka.Timeout)
+	}
+	if ka.MaxMissed < 0 {
+		return fmt.Errorf("KeepAlive.MaxMissed cannot be negative: %v", ka.MaxMissed)
+	}
+	return nil
+}
+
+// keepAliveLoop pings the peer whenever no frame was read from it for an
+// interval and closes the connection once it misses ka.MaxMissed pongs in a row.
+func (c *Conn) keepAliveLoop(ka KeepAlive) {
+	if ka.Timeout == 0 {
+		ka.Timeout = ka.Interval
+	}
+	if ka.MaxMissed == 0 {
+		ka.MaxMissed = 1
+	}
+
+	t := time.NewTicker(ka.Interval)
+	defer t.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-t.C:
+		}
+
+		if atomic.SwapInt32(&c.readActivity, 0) == 1 {
+			missed = 0
+			continue
+		}
+
+		ok, err := c.keepAlivePing(ka.Timeout)
+		if err != nil {
+			return
+		}
+		if ok {
+			missed = 0
+			continue
+		}
+
+		missed++
+		if missed >= ka.MaxMissed {
+			c.writeError(StatusGoingAway, KeepAliveError{Missed: missed})
+			return
+		}
+	}
+}
+
+// keepAlivePing pings the peer and reports whether the pong was received
+// within timeout. Unlike Ping, it does not close the connection on timeout.
+func (c *Conn) keepAlivePing(timeout time.Duration) (bool, error) {
+	p, pong := c.addCounterPing()
+	defer c.removeActivePing(p)
+
+	err := c.writeControl(context.Background(), opPing, []byte(p))
+	if err != nil {
+		return false, err
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-c.closed:
+		return false, c.closeErr
+	case <-t.C:
+		return false, nil
+	case <-pong:
+		return true, nil
+	}
+}
+
 type mu struct {
 	c  *Conn
 	ch chan struct{}
@@ -263,3 +522,12 @@ func (m *mu) unlock() {
 	default:
 	}
 }
+
+// withTimeout is like context.WithTimeout but a negative
+// timeout means no timeout.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout < 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
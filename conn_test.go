@@ -5,9 +5,11 @@ package websocket_test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -39,15 +41,36 @@ func TestConn(t *testing.T) {
 		compressionMode := func() websocket.CompressionMode {
 			return websocket.CompressionMode(xrand.Int(int(websocket.CompressionDisabled) + 1))
 		}
+		windowBits := func() int {
+			return 8 + xrand.Int(8)
+		}
+		compressionLevel := func() int {
+			return xrand.Int(12) - 2
+		}
+		dict := xrand.Bytes(1 + xrand.Int(65536))
+		presetDictionary := func() []byte {
+			if xrand.Bool() {
+				return dict
+			}
+			return nil
+		}
 
 		for i := 0; i < 5; i++ {
 			t.Run("", func(t *testing.T) {
 				tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
-					CompressionMode:      compressionMode(),
-					CompressionThreshold: xrand.Int(9999),
+					CompressionMode:             compressionMode(),
+					CompressionThreshold:        xrand.Int(9999),
+					CompressionMaxWindowBits:    windowBits(),
+					CompressionLevel:            compressionLevel(),
+					CompressionPresetDictionary: presetDictionary(),
+					AdaptiveCompression:         xrand.Bool(),
 				}, &websocket.AcceptOptions{
-					CompressionMode:      compressionMode(),
-					CompressionThreshold: xrand.Int(9999),
+					CompressionMode:             compressionMode(),
+					CompressionThreshold:        xrand.Int(9999),
+					CompressionMaxWindowBits:    windowBits(),
+					CompressionLevel:            compressionLevel(),
+					CompressionPresetDictionary: presetDictionary(),
+					AdaptiveCompression:         xrand.Bool(),
 				})
 				defer tt.cleanup()
 
@@ -66,6 +89,42 @@ func TestConn(t *testing.T) {
 		}
 	})
 
+	t.Run("zstd", func(t *testing.T) {
+		dict := xrand.Bytes(1 + xrand.Int(4096))
+		zstdOptions := func() *websocket.ZstdOptions {
+			opts := &websocket.ZstdOptions{
+				Mode:      websocket.CompressionMode(xrand.Int(int(websocket.CompressionDisabled) + 1)),
+				Threshold: xrand.Int(9999),
+				Level:     xrand.Int(23),
+			}
+			if xrand.Bool() {
+				opts.Dictionary = dict
+			}
+			return opts
+		}
+
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+			Zstd:            zstdOptions(),
+		}, &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+			Zstd:            zstdOptions(),
+		})
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		c1.SetReadLimit(131072)
+
+		for i := 0; i < 5; i++ {
+			err := wstest.Echo(tt.ctx, c1, 131072)
+			assert.Success(t, err)
+		}
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
 	t.Run("badClose", func(t *testing.T) {
 		tt, c1, _ := newConnTest(t, nil, nil)
 		defer tt.cleanup()
@@ -90,6 +149,88 @@ func TestConn(t *testing.T) {
 		assert.Success(t, err)
 	})
 
+	t.Run("pingPong", func(t *testing.T) {
+		pings := make(chan string, 1)
+		pongs := make(chan string, 1)
+		onPing := func(p []byte) {
+			pings <- string(p)
+		}
+		onPong := func(p []byte) {
+			pongs <- string(p)
+		}
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			OnPing: onPing,
+			OnPong: onPong,
+		}, &websocket.AcceptOptions{
+			OnPing: onPing,
+			OnPong: onPong,
+		})
+		defer tt.cleanup()
+
+		c1.CloseRead(tt.ctx)
+		c2.CloseRead(tt.ctx)
+
+		assert.Equal(t, "rtt", time.Duration(0), c1.RTT())
+		err := c1.PingPayload(tt.ctx, []byte("hello"))
+		assert.Success(t, err)
+		assert.Equal(t, "ping", "hello", <-pings)
+		assert.Equal(t, "pong", "hello", <-pongs)
+		if c1.RTT() <= 0 {
+			t.Fatalf("expected positive rtt: %v", c1.RTT())
+		}
+
+		// Unsolicited pongs are not answered.
+		err = c2.Pong(tt.ctx, []byte("heartbeat"))
+		assert.Success(t, err)
+		assert.Equal(t, "pong", "heartbeat", <-pongs)
+
+		err = c1.PingPayload(tt.ctx, xrand.Bytes(126))
+		assert.Contains(t, err, "exceeds the maximum")
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("pingPayloadInFlight", func(t *testing.T) {
+		pings := make(chan string, 1)
+		onPing := func(p []byte) {
+			pings <- string(p)
+		}
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			OnPing: onPing,
+		}, &websocket.AcceptOptions{
+			OnPing: onPing,
+		})
+		defer tt.cleanup()
+
+		// c2 still reads but its pongs never arrive so the pings stay in flight.
+		c2.DiscardWrites()
+		c2.CloseRead(tt.ctx)
+		c1.CloseRead(tt.ctx)
+
+		ctx, cancel := context.WithCancel(tt.ctx)
+		defer cancel()
+
+		errs := make(chan error, 2)
+		go func() {
+			errs <- c1.PingPayload(ctx, []byte("1"))
+		}()
+		assert.Equal(t, "ping", "1", <-pings)
+
+		err := c1.PingPayload(ctx, []byte("1"))
+		assert.Contains(t, err, "already in flight")
+
+		// Ping skips the counter value in use by PingPayload.
+		go func() {
+			errs <- c1.Ping(ctx)
+		}()
+		assert.Equal(t, "ping", "2", <-pings)
+
+		cancel()
+		assert.Error(t, <-errs)
+		assert.Error(t, <-errs)
+	})
+
 	t.Run("badPing", func(t *testing.T) {
 		tt, c1, c2 := newConnTest(t, nil, nil)
 		defer tt.cleanup()
@@ -103,6 +244,235 @@ func TestConn(t *testing.T) {
 		assert.Contains(t, err, "failed to wait for pong")
 	})
 
+	t.Run("closeTimeout", func(t *testing.T) {
+		tt, c1, _ := newConnTest(t, &websocket.DialOptions{
+			ControlTimeout: time.Millisecond * 100,
+			CloseTimeout:   time.Millisecond * 100,
+		}, &websocket.AcceptOptions{
+			ControlTimeout: time.Millisecond * 100,
+			CloseTimeout:   time.Millisecond * 100,
+		})
+		defer tt.cleanup()
+
+		// The peer never reads so the close frame cannot be written.
+		start := time.Now()
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Contains(t, err, "deadline exceeded")
+		if d := time.Since(start); d > time.Second*2 {
+			t.Fatalf("close took %v", d)
+		}
+	})
+
+	t.Run("closeContext", func(t *testing.T) {
+		// Only the context bounds the close handshake.
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			ControlTimeout: -1,
+			CloseTimeout:   -1,
+		}, &websocket.AcceptOptions{
+			ControlTimeout: -1,
+			CloseTimeout:   -1,
+		})
+		defer tt.cleanup()
+
+		ctx, cancel := context.WithTimeout(tt.ctx, time.Millisecond*100)
+		defer cancel()
+
+		start := time.Now()
+		err := c1.CloseContext(ctx, websocket.StatusNormalClosure, "")
+		assert.Contains(t, err, "deadline exceeded")
+		if d := time.Since(start); d > time.Second*2 {
+			t.Fatalf("close took %v", d)
+		}
+
+		err = c2.CloseContext(ctx, websocket.StatusNormalClosure, "")
+		assert.Error(t, err)
+	})
+
+	t.Run("keepAlive", func(t *testing.T) {
+		pongs := make(chan struct{}, 1)
+		// Only the client pings as net.Pipe is unbuffered and both sides
+		// writing pongs to each other at once would deadlock.
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			KeepAlive: &websocket.KeepAlive{
+				Interval: time.Millisecond * 10,
+			},
+			OnPong: func([]byte) {
+				select {
+				case pongs <- struct{}{}:
+				default:
+				}
+			},
+		}, nil)
+		defer tt.cleanup()
+
+		tt.goDiscardLoop(c2)
+
+		waitPong := func() {
+			t.Helper()
+			select {
+			case <-pongs:
+			case <-tt.ctx.Done():
+				t.Fatal("no pong received")
+			}
+		}
+
+		// Both idle and busy connections stay up.
+		c1.CloseRead(tt.ctx)
+		waitPong()
+		for i := 0; i < 10; i++ {
+			err := c1.Write(tt.ctx, websocket.MessageText, []byte("hello"))
+			assert.Success(t, err)
+		}
+		select {
+		case <-pongs:
+		default:
+		}
+		waitPong()
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("keepAliveDeadPeer", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			KeepAlive: &websocket.KeepAlive{
+				Interval:  time.Millisecond * 10,
+				MaxMissed: 3,
+			},
+		}, &websocket.AcceptOptions{
+			KeepAlive: &websocket.KeepAlive{
+				Interval:  time.Millisecond * 10,
+				MaxMissed: 3,
+			},
+		})
+		defer tt.cleanup()
+
+		// c2 still reads but its pongs never arrive.
+		c2.DiscardWrites()
+		c2.CloseRead(tt.ctx)
+
+		_, _, err := c1.Read(tt.ctx)
+		var kerr websocket.KeepAliveError
+		if !errors.As(err, &kerr) {
+			t.Fatalf("expected KeepAliveError: %v", err)
+		}
+		assert.Equal(t, "missed", 3, kerr.Missed)
+	})
+
+	t.Run("closeInfo", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		ctx2 := c2.CloseRead(tt.ctx)
+
+		err := c1.Close(websocket.StatusGoingAway, "bye")
+		assert.Success(t, err)
+		<-ctx2.Done()
+
+		ce := websocket.CloseError{Code: websocket.StatusGoingAway, Reason: "bye"}
+		ci := c1.CloseInfo()
+		assert.Equal(t, "initiator", websocket.CloseInitiatorLocal, ci.Initiator)
+		assert.Equal(t, "clean", true, ci.Clean)
+		assert.Equal(t, "sent", ce, *ci.Sent)
+		assert.Equal(t, "received", ce, *ci.Received)
+
+		ci = c2.CloseInfo()
+		assert.Equal(t, "initiator", websocket.CloseInitiatorPeer, ci.Initiator)
+		assert.Equal(t, "clean", true, ci.Clean)
+		assert.Equal(t, "sent", ce, *ci.Sent)
+		assert.Equal(t, "received", ce, *ci.Received)
+	})
+
+	t.Run("closeNow", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		ctx2 := c2.CloseRead(tt.ctx)
+
+		err := c1.CloseNow()
+		assert.Success(t, err)
+		<-ctx2.Done()
+
+		err = c1.Write(tt.ctx, websocket.MessageText, []byte("hello"))
+		assert.Contains(t, err, "closed without a close handshake")
+
+		assert.Equal(t, "c1 close info", websocket.CloseInfo{
+			Initiator: websocket.CloseInitiatorLocal,
+		}, c1.CloseInfo())
+		assert.Equal(t, "c2 close info", websocket.CloseInfo{}, c2.CloseInfo())
+	})
+
+	t.Run("halfClose", func(t *testing.T) {
+		// Without compression the message is written in a single frame
+		// so c2 cannot reply to the close frame in the middle of it.
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionDisabled,
+			HalfClose:       true,
+		}, &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionDisabled,
+			HalfClose:       true,
+		})
+		defer tt.cleanup()
+
+		// c1 writes nothing but its close frame.
+		sentClose := make(chan struct{}, 1)
+		c1.OnWrite(func() {
+			select {
+			case sentClose <- struct{}{}:
+			default:
+			}
+		})
+
+		// The message is larger than c1's read buffer so c2 is still
+		// writing it once c1 has read the header.
+		msg := xrand.Bytes(1 << 13)
+		c1.SetReadLimit(int64(len(msg)))
+		writeErr := xsync.Go(func() error {
+			return c2.Write(tt.ctx, websocket.MessageBinary, msg)
+		})
+		_, r, err := c1.Reader(tt.ctx)
+		assert.Success(t, err)
+
+		closeErr := xsync.Go(func() error {
+			return c1.Close(websocket.StatusNormalClosure, "")
+		})
+		c2.CloseRead(tt.ctx)
+		<-sentClose
+
+		// c1 has written its close frame but still receives the message.
+		b, err := ioutil.ReadAll(r)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", msg, b)
+		_, _, err = c1.Read(tt.ctx)
+		assert.Success(t, assertCloseStatus(websocket.StatusNormalClosure, err))
+
+		assert.Success(t, <-writeErr)
+		assert.Success(t, <-closeErr)
+		assert.Equal(t, "clean", true, c1.CloseInfo().Clean)
+	})
+
+	t.Run("halfCloseFromReader", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			HalfClose:    true,
+			CloseTimeout: time.Millisecond * 100,
+		}, &websocket.AcceptOptions{
+			HalfClose:    true,
+			CloseTimeout: time.Millisecond * 100,
+		})
+		defer tt.cleanup()
+
+		c2.CloseRead(tt.ctx)
+
+		// As with a deferred Close in a read loop, nothing reads
+		// the peer's close frame while Close waits for it.
+		start := time.Now()
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Contains(t, err, "deadline exceeded")
+		if d := time.Since(start); d < time.Millisecond*100 {
+			t.Fatalf("close returned after %v", d)
+		}
+	})
+
 	t.Run("concurrentWrite", func(t *testing.T) {
 		tt, c1, c2 := newConnTest(t, nil, nil)
 		defer tt.cleanup()
@@ -162,9 +532,9 @@ func TestConn(t *testing.T) {
 		n1.SetDeadline(d)
 		n1.SetDeadline(time.Time{})
 
-		assert.Equal(t, "remote addr", n1.RemoteAddr(), n1.LocalAddr())
-		assert.Equal(t, "remote addr string", "websocket/unknown-addr", n1.RemoteAddr().String())
-		assert.Equal(t, "remote addr network", "websocket", n1.RemoteAddr().Network())
+		// wstest.Pipe runs over net.Pipe.
+		assert.Equal(t, "remote addr network", "pipe", n1.RemoteAddr().Network())
+		assert.Equal(t, "local addr network", "pipe", n1.LocalAddr().Network())
 
 		errs := xsync.Go(func() error {
 			_, err := n2.Write([]byte("hello"))
@@ -190,6 +560,61 @@ func TestConn(t *testing.T) {
 		assert.Equal(t, "read msg", []byte("hello"), b)
 	})
 
+	t.Run("netConn/Deadline", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		n1 := websocket.NetConn(tt.ctx, c1, websocket.MessageBinary)
+		n2 := websocket.NetConn(tt.ctx, c2, websocket.MessageBinary)
+
+		assertTimeout := func(err error) {
+			t.Helper()
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				t.Fatalf("expected timeout net.Error: %#v", err)
+			}
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("expected os.ErrDeadlineExceeded: %v", err)
+			}
+		}
+
+		n1.SetReadDeadline(time.Now().Add(-time.Second))
+		_, err := n1.Read(make([]byte, 5))
+		assertTimeout(err)
+
+		// The deadline expires while the read is pending.
+		n1.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+		_, err = n1.Read(make([]byte, 5))
+		assertTimeout(err)
+
+		n2.SetWriteDeadline(time.Now().Add(-time.Second))
+		_, err = n2.Write([]byte("hello"))
+		assertTimeout(err)
+
+		// Both connections remain usable once the deadlines are cleared.
+		n1.SetReadDeadline(time.Time{})
+		n2.SetWriteDeadline(time.Time{})
+
+		errs := xsync.Go(func() error {
+			_, err := n2.Write([]byte("hello"))
+			if err != nil {
+				return err
+			}
+			return n2.Close()
+		})
+
+		b, err := ioutil.ReadAll(n1)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", []byte("hello"), b)
+
+		select {
+		case err := <-errs:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+	})
+
 	t.Run("netConn/BadMsg", func(t *testing.T) {
 		tt, c1, c2 := newConnTest(t, nil, nil)
 		defer tt.cleanup()
@@ -264,6 +689,130 @@ func TestConn(t *testing.T) {
 		err = c1.Close(websocket.StatusNormalClosure, "")
 		assert.Success(t, err)
 	})
+
+	t.Run("readLimits", func(t *testing.T) {
+		t.Parallel()
+
+		testCases := []struct {
+			name   string
+			limit  func(c *websocket.Conn)
+			msg    []byte
+			expErr websocket.ReadLimitError
+		}{
+			{
+				name:   "message",
+				limit:  func(c *websocket.Conn) { c.SetReadLimit(1024) },
+				msg:    xrand.Bytes(2048),
+				expErr: websocket.ReadLimitError{Limit: websocket.ReadLimitMessage, Max: 1024},
+			},
+			{
+				name:   "wire",
+				limit:  func(c *websocket.Conn) { c.SetWireReadLimit(1024) },
+				msg:    xrand.Bytes(2048),
+				expErr: websocket.ReadLimitError{Limit: websocket.ReadLimitWire, Max: 1024},
+			},
+			{
+				name: "expansion",
+				limit: func(c *websocket.Conn) {
+					c.SetReadLimit(1 << 20)
+					c.SetReadExpansionLimit(10)
+				},
+				msg:    make([]byte, 1<<20),
+				expErr: websocket.ReadLimitError{Limit: websocket.ReadLimitExpansion, Max: 10},
+			},
+		}
+		for _, tc := range testCases {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+					CompressionMode: websocket.CompressionContextTakeover,
+				}, &websocket.AcceptOptions{
+					CompressionMode: websocket.CompressionContextTakeover,
+				})
+				defer tt.cleanup()
+
+				tc.limit(c2)
+				rerr := xsync.Go(func() error {
+					_, _, err := c1.Read(tt.ctx)
+					return assertCloseStatus(websocket.StatusMessageTooBig, err)
+				})
+				go c1.Write(tt.ctx, websocket.MessageBinary, tc.msg)
+
+				_, _, err := c2.Read(tt.ctx)
+				var rle websocket.ReadLimitError
+				if !errors.As(err, &rle) {
+					t.Fatalf("expected websocket.ReadLimitError: %+v", err)
+				}
+				assert.Equal(t, "read limit error", tc.expErr, rle)
+
+				select {
+				case err := <-rerr:
+					assert.Success(t, err)
+				case <-tt.ctx.Done():
+					t.Fatal(tt.ctx.Err())
+				}
+			})
+		}
+	})
+
+	t.Run("writeCompression", func(t *testing.T) {
+		rsvs := make(chan websocket.RSV, 8)
+		exts := []websocket.Extension{rsvExtension{rsvs: rsvs}}
+		predicate := func(typ websocket.MessageType, size int) bool {
+			return typ == websocket.MessageText
+		}
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode:      websocket.CompressionContextTakeover,
+			CompressionPredicate: predicate,
+			Extensions:           exts,
+		}, &websocket.AcceptOptions{
+			CompressionMode:      websocket.CompressionContextTakeover,
+			CompressionPredicate: predicate,
+			Extensions:           exts,
+		})
+		defer tt.cleanup()
+
+		testCases := []struct {
+			typ        websocket.MessageType
+			opts       *websocket.WriteOptions
+			compressed bool
+		}{
+			{websocket.MessageText, nil, true},
+			{websocket.MessageBinary, nil, false},
+			{websocket.MessageBinary, &websocket.WriteOptions{Compression: websocket.MessageCompressionForce}, true},
+			{websocket.MessageText, &websocket.WriteOptions{Compression: websocket.MessageCompressionSkip}, false},
+		}
+
+		msg := []byte(xrand.String(xrand.Int(1024)))
+		werr := xsync.Go(func() error {
+			for _, tc := range testCases {
+				err := c1.WriteWithOptions(tt.ctx, tc.typ, msg, tc.opts)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		for _, tc := range testCases {
+			typ, p, err := c2.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "type", tc.typ, typ)
+			assert.Equal(t, "msg", msg, p)
+			assert.Equal(t, "compressed", tc.compressed, <-rsvs&websocket.RSV1 != 0)
+		}
+
+		select {
+		case err := <-werr:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+
+		c2.CloseRead(tt.ctx)
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
 }
 
 func TestWasm(t *testing.T) {
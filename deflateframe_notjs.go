@@ -0,0 +1,176 @@
+// +build !js
+
+package websocket
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// deflateFrameExtension implements x-webkit-deflate-frame, the deflate-frame
+// extension as implemented by WebKit. Unlike permessage-deflate, it compresses
+// the payload of every data frame and the sliding window is shared across frames.
+// See https://tools.ietf.org/html/draft-tyoshino-hybi-websocket-perframe-deflate-06
+//
+// Its only parameter is no_context_takeover with which either side asks the other
+// not to use context takeover. There is no way to signal that we will not use it
+// ourselves but the peer can always decompress frames compressed without it.
+type deflateFrameExtension struct {
+	mode      CompressionMode
+	threshold int
+	level     int
+}
+
+var _ Extension = deflateFrameExtension{}
+
+func (e deflateFrameExtension) Name() string {
+	return "x-webkit-deflate-frame"
+}
+
+func (e deflateFrameExtension) params() []string {
+	if e.mode == CompressionNoContextTakeover {
+		return []string{"no_context_takeover"}
+	}
+	return nil
+}
+
+func (e deflateFrameExtension) Offer() []string {
+	return e.params()
+}
+
+func (e deflateFrameExtension) Accept(params []string) (ExtensionConn, []string, error) {
+	peerNoContextTakeover, err := parseDeflateFrameParams(params)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e.newConn(peerNoContextTakeover), e.params(), nil
+}
+
+func (e deflateFrameExtension) Negotiated(params []string) (ExtensionConn, error) {
+	peerNoContextTakeover, err := parseDeflateFrameParams(params)
+	if err != nil {
+		return nil, err
+	}
+	return e.newConn(peerNoContextTakeover), nil
+}
+
+// parseDeflateFrameParams reports whether the peer asked
+// for no context takeover.
+func parseDeflateFrameParams(params []string) (bool, error) {
+	noContextTakeover := false
+	for _, p := range params {
+		if p == "no_context_takeover" {
+			noContextTakeover = true
+			continue
+		}
+
+		// We explicitly fail on x-webkit-deflate-frame's max_window_bits parameter instead
+		// of ignoring it as the draft spec is unclear. It says the server can ignore it
+		// but the server has no way of signalling to the client it was ignored as the parameters
+		// are set one way.
+		// Thus us ignoring it would make the client think we understood it which would cause issues.
+		// See https://tools.ietf.org/html/draft-tyoshino-hybi-websocket-perframe-deflate-06#section-4.1
+		//
+		// Either way, we're only implementing this for webkit which never sends the max_window_bits
+		// parameter so we don't need to worry about it.
+		return false, fmt.Errorf("unsupported x-webkit-deflate-frame parameter: %q", p)
+	}
+	return noContextTakeover, nil
+}
+
+// deflateFrameConn is the x-webkit-deflate-frame state of a connection.
+type deflateFrameConn struct {
+	threshold            int
+	writeContextTakeover bool
+	readContextTakeover  bool
+
+	fw   deflateWriter
+	wbuf bytes.Buffer
+
+	fr   deflateReader
+	src  bytes.Reader
+	rbuf bytes.Buffer
+	// readLimit returns the read limit of the connection
+	// to bound the decompressed size of a frame if set.
+	readLimit func() int64
+}
+
+var _ FrameTransformer = &deflateFrameConn{}
+
+func (e deflateFrameExtension) newConn(peerNoContextTakeover bool) *deflateFrameConn {
+	wc := &deflateFrameConn{
+		threshold:            e.threshold,
+		writeContextTakeover: e.mode == CompressionContextTakeover && !peerNoContextTakeover,
+		readContextTakeover:  e.mode == CompressionContextTakeover,
+	}
+	if wc.threshold == 0 {
+		wc.threshold = 128
+		if !wc.writeContextTakeover {
+			wc.threshold = 512
+		}
+	}
+	wc.fw.level = e.level
+	return wc
+}
+
+// initConn bounds the decompressed size of frames by the read limit of c.
+func (wc *deflateFrameConn) initConn(c *Conn) {
+	wc.readLimit = func() int64 {
+		return c.msgReader.limitReader.limit.Load()
+	}
+}
+
+func (wc *deflateFrameConn) RSV() RSV {
+	return RSV1
+}
+
+func (wc *deflateFrameConn) Close() error {
+	wc.fw.close()
+	wc.fr.close()
+	return nil
+}
+
+func (wc *deflateFrameConn) WriteFrame(p []byte, fin bool) ([]byte, RSV, error) {
+	if len(p) < wc.threshold {
+		return p, 0, nil
+	}
+
+	wc.wbuf.Reset()
+	wc.fw.reset(&wc.wbuf, wc.writeContextTakeover, maxWindowBits, nil)
+	_, err := wc.fw.Write(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = wc.fw.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+	return wc.wbuf.Bytes(), RSV1, nil
+}
+
+func (wc *deflateFrameConn) ReadFrame(p []byte, rsv RSV, fin bool) ([]byte, error) {
+	if rsv&RSV1 == 0 {
+		return p, nil
+	}
+
+	wc.src.Reset(p)
+	wc.fr.reset(&wc.src, wc.readContextTakeover, maxWindowBits, nil)
+
+	var r io.Reader = &wc.fr
+	limit := int64(-1)
+	if wc.readLimit != nil {
+		limit = wc.readLimit()
+		r = io.LimitReader(r, limit)
+	}
+
+	wc.rbuf.Reset()
+	_, err := wc.rbuf.ReadFrom(r)
+	if err != nil {
+		return nil, err
+	}
+	if int64(wc.rbuf.Len()) == limit {
+		return nil, ReadLimitError{Limit: ReadLimitMessage, Max: limit - 1}
+	}
+	return wc.rbuf.Bytes(), nil
+}
@@ -0,0 +1,278 @@
+// +build !js
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket/internal/test/assert"
+	"nhooyr.io/websocket/internal/test/xrand"
+)
+
+func Test_deflateFrameExtension(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name                       string
+		mode                       CompressionMode
+		reqSecWebSocketExtensions  string
+		respSecWebSocketExtensions string
+		writeContextTakeover       bool
+		readContextTakeover        bool
+		error                      bool
+	}{
+		{
+			name:                       "contextTakeover",
+			mode:                       CompressionContextTakeover,
+			reqSecWebSocketExtensions:  "x-webkit-deflate-frame",
+			respSecWebSocketExtensions: "x-webkit-deflate-frame",
+			writeContextTakeover:       true,
+			readContextTakeover:        true,
+		},
+		{
+			name:                       "peerNoContextTakeover",
+			mode:                       CompressionContextTakeover,
+			reqSecWebSocketExtensions:  "x-webkit-deflate-frame; no_context_takeover",
+			respSecWebSocketExtensions: "x-webkit-deflate-frame",
+			readContextTakeover:        true,
+		},
+		{
+			name:                       "noContextTakeover",
+			mode:                       CompressionNoContextTakeover,
+			reqSecWebSocketExtensions:  "x-webkit-deflate-frame; no_context_takeover",
+			respSecWebSocketExtensions: "x-webkit-deflate-frame; no_context_takeover",
+		},
+		{
+			name:                       "preferPermessageDeflate",
+			mode:                       CompressionNoContextTakeover,
+			reqSecWebSocketExtensions:  "permessage-deflate, x-webkit-deflate-frame",
+			respSecWebSocketExtensions: "permessage-deflate; client_no_context_takeover; server_no_context_takeover",
+		},
+		{
+			name:                      "error",
+			mode:                      CompressionNoContextTakeover,
+			reqSecWebSocketExtensions: "x-webkit-deflate-frame; max_window_bits",
+			error:                     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Sec-WebSocket-Extensions", tc.reqSecWebSocketExtensions)
+
+			opts := &AcceptOptions{
+				CompressionMode:         tc.mode,
+				CompressionDeflateFrame: true,
+			}
+			w := httptest.NewRecorder()
+			exts, err := acceptExtensions(r, w, opts.extensions())
+			if tc.error {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.Success(t, err)
+			assert.Equal(t, "Sec-WebSocket-Extensions", tc.respSecWebSocketExtensions, w.Header().Get("Sec-WebSocket-Extensions"))
+			assert.Equal(t, "extensions", 1, len(exts))
+			defer exts[0].Close()
+			wc, ok := exts[0].(*deflateFrameConn)
+			if !ok {
+				return
+			}
+			assert.Equal(t, "writeContextTakeover", tc.writeContextTakeover, wc.writeContextTakeover)
+			assert.Equal(t, "readContextTakeover", tc.readContextTakeover, wc.readContextTakeover)
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Sec-WebSocket-Extensions", "x-webkit-deflate-frame")
+
+		w := httptest.NewRecorder()
+		exts, err := acceptExtensions(r, w, (&AcceptOptions{}).extensions())
+		assert.Success(t, err)
+		assert.Equal(t, "extensions", 0, len(exts))
+		assert.Equal(t, "Sec-WebSocket-Extensions", "", w.Header().Get("Sec-WebSocket-Extensions"))
+	})
+}
+
+func Test_deflateFrameConn(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range []CompressionMode{CompressionContextTakeover, CompressionNoContextTakeover} {
+		mode := mode
+		t.Run(fmt.Sprintf("%v", mode), func(t *testing.T) {
+			t.Parallel()
+
+			e := deflateFrameExtension{
+				mode:      mode,
+				threshold: 1,
+			}
+			client := e.newConn(false)
+			defer client.Close()
+			server := e.newConn(false)
+			defer server.Close()
+
+			// Each frame is compressed on its own but with context takeover
+			// the window carries over to the frames after it.
+			for i := 0; i < 10; i++ {
+				msg := strings.Repeat(xrand.String(1+xrand.Int(128)), 1+xrand.Int(512))
+				for p := msg; len(p) > 0; {
+					n := 1 + xrand.Int(len(p))
+					b, rsv, err := client.WriteFrame([]byte(p[:n]), n == len(p))
+					assert.Success(t, err)
+					assert.Equal(t, "rsv", RSV1, rsv)
+					b, err = server.ReadFrame(append([]byte(nil), b...), rsv, n == len(p))
+					assert.Success(t, err)
+					assert.Equal(t, "frame", p[:n], string(b))
+					p = p[n:]
+				}
+			}
+		})
+	}
+
+	t.Run("threshold", func(t *testing.T) {
+		t.Parallel()
+
+		wc := deflateFrameExtension{mode: CompressionContextTakeover}.newConn(false)
+		defer wc.Close()
+
+		b, rsv, err := wc.WriteFrame([]byte("hello"), true)
+		assert.Success(t, err)
+		assert.Equal(t, "rsv", RSV(0), rsv)
+		assert.Equal(t, "frame", "hello", string(b))
+
+		b, err = wc.ReadFrame([]byte("hello"), 0, true)
+		assert.Success(t, err)
+		assert.Equal(t, "frame", "hello", string(b))
+	})
+
+	t.Run("readLimit", func(t *testing.T) {
+		t.Parallel()
+
+		e := deflateFrameExtension{
+			mode:      CompressionNoContextTakeover,
+			threshold: 1,
+		}
+		client := e.newConn(false)
+		defer client.Close()
+		server := e.newConn(false)
+		defer server.Close()
+		server.readLimit = func() int64 {
+			return 1025
+		}
+
+		b, rsv, err := client.WriteFrame([]byte(strings.Repeat("a", 1024)), true)
+		assert.Success(t, err)
+		_, err = server.ReadFrame(append([]byte(nil), b...), rsv, true)
+		assert.Success(t, err)
+
+		b, rsv, err = client.WriteFrame([]byte(strings.Repeat("a", 1025)), true)
+		assert.Success(t, err)
+		_, err = server.ReadFrame(b, rsv, true)
+		var rerr ReadLimitError
+		if !errors.As(err, &rerr) {
+			t.Fatalf("expected ReadLimitError: %v", err)
+		}
+		assert.Equal(t, "max", int64(1024), rerr.Max)
+	})
+}
+
+func TestDeflateFrame(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range []CompressionMode{CompressionContextTakeover, CompressionNoContextTakeover} {
+		mode := mode
+		t.Run(fmt.Sprintf("%v", mode), func(t *testing.T) {
+			t.Parallel()
+
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				c, err := Accept(w, r, &AcceptOptions{
+					CompressionMode:         mode,
+					CompressionDeflateFrame: true,
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer c.Close(StatusInternalError, "")
+				c.SetReadLimit(1 << 20)
+
+				for {
+					typ, p, err := c.Read(r.Context())
+					if CloseStatus(err) == StatusNormalClosure {
+						return
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					err = c.Write(r.Context(), typ, p)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}))
+			defer s.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+			defer cancel()
+
+			// Browsers are the only clients of x-webkit-deflate-frame so
+			// there is no dial option for it.
+			c, _, err := Dial(ctx, s.URL, &DialOptions{
+				CompressionMode: CompressionDisabled,
+				Extensions:      []Extension{deflateFrameExtension{mode: mode}},
+			})
+			assert.Success(t, err)
+			defer c.Close(StatusInternalError, "")
+			c.SetReadLimit(1 << 20)
+
+			exp := "x-webkit-deflate-frame"
+			if mode == CompressionNoContextTakeover {
+				exp += "; no_context_takeover"
+			}
+			assert.Equal(t, "Sec-WebSocket-Extensions", exp, c.HandshakeInfo().ResponseHeader.Get("Sec-WebSocket-Extensions"))
+
+			for i := 0; i < 5; i++ {
+				// Write a fragmented message.
+				msg := strings.Repeat(xrand.String(1+xrand.Int(64)), 1+xrand.Int(4096))
+				w, err := c.Writer(ctx, MessageText)
+				assert.Success(t, err)
+				for p := msg; len(p) > 0; {
+					n := 1 + xrand.Int(len(p))
+					_, err = w.Write([]byte(p[:n]))
+					assert.Success(t, err)
+					p = p[n:]
+				}
+				err = w.Close()
+				assert.Success(t, err)
+
+				typ, r, err := c.Reader(ctx)
+				assert.Success(t, err)
+				assert.Equal(t, "type", MessageText, typ)
+				b, err := ioutil.ReadAll(r)
+				assert.Success(t, err)
+				assert.Equal(t, "msg", msg, string(b))
+			}
+
+			err = c.Close(StatusNormalClosure, "")
+			assert.Success(t, err)
+		})
+	}
+}
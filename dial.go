@@ -7,12 +7,15 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strings"
 	"sync"
@@ -28,6 +31,69 @@ type DialOptions struct {
 	// http.Transport does beginning with Go 1.12.
 	HTTPClient *http.Client
 
+	// HTTP2Client enables WebSockets over HTTP/2 as per RFC 8441.
+	// See https://tools.ietf.org/html/rfc8441
+	//
+	// When set, the handshake is first attempted as an extended CONNECT request with
+	// HTTP2Client which allows many WebSockets to share a single connection to the
+	// same origin. Its Transport must support extended CONNECT such as
+	// golang.org/x/net/http2.Transport. net/http's Transport does not yet.
+	// See https://github.com/golang/go/issues/53208
+	//
+	// If the server does not advertise SETTINGS_ENABLE_CONNECT_PROTOCOL, Dial falls back
+	// to an HTTP/1.1 handshake with HTTPClient.
+	HTTP2Client *http.Client
+
+	// HTTP3Client enables WebSockets over HTTP/3 as per RFC 9220.
+	// See https://tools.ietf.org/html/rfc9220
+	//
+	// When set, the handshake is first attempted as an extended CONNECT request with
+	// HTTP3Client before HTTP2Client and HTTPClient. Its Transport must be a
+	// github.com/quic-go/quic-go/http3.Transport which sends the :protocol pseudo
+	// header from Request.Proto.
+	//
+	// If the server does not advertise SETTINGS_ENABLE_CONNECT_PROTOCOL, Dial falls back
+	// to HTTP2Client if set and otherwise to an HTTP/1.1 handshake with HTTPClient.
+	HTTP3Client *http.Client
+
+	// NetDialContext is used to dial the network connection for HTTPClient.
+	// Defaults to the Transport's DialContext if it is an *http.Transport.
+	//
+	// When NetDialContext, Proxy or any of the socket options below are set, Dial
+	// makes the connection for HTTPClient itself and sends the handshake request
+	// on it instead of through HTTPClient's Transport. If the Transport is an
+	// *http.Transport, its TLSClientConfig is used for wss URLs.
+	// They do not apply to HTTP2Client or HTTP3Client.
+	NetDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// DisableTCPNoDelay disables TCP_NODELAY which Go enables by default.
+	// Enable it if you write many small messages and prefer throughput over latency.
+	DisableTCPNoDelay bool
+
+	// TCPKeepAlive sets the period between TCP keep alive probes.
+	// Zero leaves the dialer's setting in place and a negative value disables
+	// keep alive probes.
+	TCPKeepAlive time.Duration
+
+	// SocketReadBufferSize and SocketWriteBufferSize set the size of the
+	// operating system's receive and send buffers for the connection.
+	// Zero leaves the operating system's defaults in place.
+	SocketReadBufferSize  int
+	SocketWriteBufferSize int
+
+	// Proxy returns the proxy to tunnel the connection through for a handshake
+	// request. Use http.ProxyFromEnvironment to take it from the environment.
+	// If Proxy is nil, HTTPClient's Transport decides. If it returns a nil URL,
+	// no proxy is used.
+	//
+	// http and https proxies are tunneled through with HTTP CONNECT and socks5
+	// and socks5h proxies with SOCKS5. socks5 resolves the host locally while
+	// socks5h leaves it to the proxy. User info in the proxy URL is used for basic
+	// authentication and SOCKS5 username/password authentication respectively.
+	//
+	// Like NetDialContext, Proxy does not apply to HTTP2Client or HTTP3Client.
+	Proxy func(*http.Request) (*url.URL, error)
+
 	// HTTPHeader specifies the HTTP headers included in the handshake request.
 	HTTPHeader http.Header
 
@@ -43,8 +109,146 @@ type DialOptions struct {
 	// CompressionThreshold controls the minimum size of a message before compression is applied.
 	//
 	// Defaults to 512 bytes for CompressionNoContextTakeover and 128 bytes
-	// for CompressionContextTakeover.
+	// for CompressionContextTakeover or 32 bytes with a negotiated
+	// CompressionPresetDictionary.
 	CompressionThreshold int
+
+	// CompressionPredicate, if set, decides whether a message is compressed
+	// instead of CompressionThreshold. It is passed the type of the message and
+	// its size, or with Conn.Writer, the size of the first write.
+	//
+	// WriteOptions passed to Conn.WriteWithOptions or Conn.WriterWithOptions
+	// take precedence.
+	CompressionPredicate func(typ MessageType, size int) bool
+
+	// AdaptiveCompression stops compressing messages while they compress poorly,
+	// as judged by the ratio recent messages were compressed with, and skips
+	// messages whose first write looks random. It resumes compressing when
+	// messages compress well again.
+	//
+	// Use this if some messages are compressible and others, such as images,
+	// are already compressed.
+	AdaptiveCompression bool
+
+	// CompressionMaxWindowBits is the base 2 logarithm of the largest LZ77 sliding
+	// window, between 8 and 15, that the peer is asked to compress messages with and
+	// that messages are compressed with. Smaller windows lower the memory held by
+	// connections with context takeover at the expense of compression ratio.
+	//
+	// Defaults to 15, a 32 KiB window.
+	CompressionMaxWindowBits int
+
+	// CompressionLevel is the flate compression level messages are compressed with,
+	// from flate.HuffmanOnly (-2) to flate.BestCompression (9). Higher levels trade
+	// CPU for a better compression ratio. See the compress/flate package.
+	//
+	// With context takeover, a flate.Writer of 300 kB to 1 MB depending on the
+	// level is kept for the lifetime of every connection unless
+	// CompressionDictionarySize is set. See CompressionContextTakeover.
+	//
+	// Defaults to flate.BestSpeed with context takeover and otherwise to a fast
+	// stateless compressor.
+	CompressionLevel int
+
+	// CompressionDictionarySize is the number of bytes of previously written messages,
+	// up to 32768, used to compress messages with context takeover. Setting it
+	// avoids keeping a flate.Writer for the lifetime of the connection at the
+	// expense of compression speed. The default compression level uses at most
+	// 8192 bytes.
+	//
+	// Defaults to the entire sliding window.
+	CompressionDictionarySize int
+
+	// CompressionPresetDictionary, if set, primes the sliding windows of both sides
+	// before the first compressed message so that even small messages compress well.
+	// Use the strings common to messages such as JSON keys and enum values. Only
+	// the last 8 KiB are used with the default CompressionLevel and 32 KiB otherwise,
+	// and only levels above 6 use it for messages under 128 bytes.
+	//
+	// It is negotiated with a private parameter and only used if the peer
+	// has the same dictionary. The offer with it is followed by a plain
+	// permessage-deflate offer which servers that decline unknown parameters,
+	// as RFC 7692 requires, fall back to. Servers that instead fail the handshake,
+	// such as earlier versions of this package, cannot be dialed with it set.
+	CompressionPresetDictionary []byte
+
+	// Zstd, if set, enables the experimental permessage-zstd extension.
+	//
+	// See docs on ZstdOptions for details.
+	Zstd *ZstdOptions
+
+	// Extensions lists the extensions to offer the server after permessage-deflate.
+	Extensions []Extension
+
+	// ControlTimeout bounds reading the payload of a control frame and writing
+	// a control frame such as the pong in response to a ping or a close frame.
+	// Raise it on high latency links where control frames are slow to arrive.
+	//
+	// Defaults to 5s. A negative value disables the timeout.
+	ControlTimeout time.Duration
+
+	// CloseTimeout bounds how long Close waits for the peer to respond to
+	// its close frame before closing the connection.
+	//
+	// Defaults to 5s. A negative value disables the timeout.
+	CloseTimeout time.Duration
+
+	// KeepAlive, if set, sends pings while the connection is idle and closes
+	// it if the peer stops responding.
+	//
+	// See docs on KeepAlive for details.
+	KeepAlive *KeepAlive
+
+	// OnPing, if set, is called with the payload of every ping received
+	// before the pong is written. OnPong is called with the payload of every
+	// pong received, including those in response to Ping.
+	//
+	// They are called by the goroutine reading the connection and so must not
+	// block. The payload must not be retained.
+	OnPing func(payload []byte)
+	OnPong func(payload []byte)
+
+	// HalfClose makes Close leave the connection half closed after writing the
+	// close frame instead of discarding the data messages the peer sent before it
+	// received the close frame. Keep calling Reader to drain them until it returns
+	// the peer's close frame as a CloseError. Close waits for that or CloseTimeout.
+	//
+	// Close must thus be called from a different goroutine than Reader. If the
+	// goroutine reading the connection calls it, e.g. with a deferred Close in a
+	// read loop, nothing reads the peer's close frame and Close returns an error
+	// after CloseTimeout.
+	//
+	// Use it if messages in flight must not be lost when closing.
+	HalfClose bool
+}
+
+func (opts *DialOptions) extensions() []Extension {
+	var exts []Extension
+	if opts.Zstd != nil && opts.Zstd.Mode != CompressionDisabled {
+		exts = append(exts, newZstdExtension(opts.Zstd))
+	}
+	if opts.CompressionMode != CompressionDisabled {
+		e := deflateExtension{
+			mode:       opts.CompressionMode,
+			threshold:  opts.CompressionThreshold,
+			predicate:  opts.CompressionPredicate,
+			adaptive:   opts.AdaptiveCompression,
+			windowBits: opts.CompressionMaxWindowBits,
+			level:      opts.CompressionLevel,
+			dictSize:   opts.CompressionDictionarySize,
+			dict:       opts.CompressionPresetDictionary,
+		}
+		exts = append(exts, e)
+		if e.dict != nil {
+			// Servers decline offers with parameters they do not know, see
+			// https://tools.ietf.org/html/rfc7692#section-5.1, so offer
+			// permessage-deflate without the dictionary too.
+			// The response is handled by the first offer.
+			e.dict = nil
+			exts = append(exts, e)
+		}
+	}
+	return append(exts, opts.Extensions...)
 }
 
 // Dial performs a WebSocket handshake on url.
@@ -60,10 +264,134 @@ type DialOptions struct {
 // See docs on the HTTPClient option and https://github.com/golang/go/issues/26937#issuecomment-415855861
 //
 // URLs with http/https schemes will work and are interpreted as ws/wss.
+//
+// URLs with ws+unix/wss+unix schemes dial the Unix domain socket at the
+// start of the URL path. The HTTP request path follows the socket path
+// after a colon, e.g. ws+unix:///var/run/app.sock:/chat?room=1.
+// The host defaults to localhost.
 func Dial(ctx context.Context, u string, opts *DialOptions) (*Conn, *http.Response, error) {
 	return dial(ctx, u, opts, nil)
 }
 
+// ClientHandshake performs a WebSocket handshake on url directly over c
+// without dialing through net/http. c must already be connected to the host
+// in url and, for wss URLs, must already be secured with TLS.
+//
+// ctx bounds the handshake only. It is not used after ClientHandshake returns.
+//
+// The HTTPClient, HTTP2Client and HTTP3Client options are ignored as are
+// NetDialContext, Proxy and the socket options. For ws+unix/wss+unix URLs only
+// the HTTP request path is used.
+// The caller is responsible for closing c if an error is returned.
+//
+// See Dial for details on the returned response.
+func ClientHandshake(ctx context.Context, c net.Conn, u string, opts *DialOptions) (*Conn, *http.Response, error) {
+	if opts == nil {
+		opts = &DialOptions{}
+	}
+	opts = &*opts
+	opts.HTTPClient = &http.Client{
+		Transport: &connTransport{c: c},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	opts.HTTP2Client = nil
+	opts.HTTP3Client = nil
+	opts.NetDialContext = nil
+	opts.DisableTCPNoDelay = false
+	opts.TCPKeepAlive = 0
+	opts.SocketReadBufferSize = 0
+	opts.SocketWriteBufferSize = 0
+	opts.Proxy = nil
+
+	u, _, err := parseUnixURL(u)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to WebSocket dial: %w", err)
+	}
+	return dial(ctx, u, opts, nil)
+}
+
+// connTransport is the http.RoundTripper that ClientHandshake uses
+// to send a single handshake request over c.
+type connTransport struct {
+	c    net.Conn
+	used bool
+}
+
+func (t *connTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.used {
+		return nil, errors.New("only a single handshake request can be sent on a connection")
+	}
+	t.used = true
+
+	ctx := req.Context()
+	if trace := httptrace.ContextClientTrace(ctx); trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Conn: t.c})
+	}
+	stop := handshakeDeadline(ctx, t.c)
+
+	bw := bufio.NewWriter(t.c)
+	err := req.Write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		if stop() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("failed to write handshake request: %w", err)
+	}
+
+	br := bufio.NewReader(t.c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		if stop() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("failed to read handshake response: %w", err)
+	}
+
+	err = stop()
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if tc, ok := t.c.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		resp.TLS = &state
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &connBody{
+			Reader: br,
+			c:      t.c,
+		}
+	} else {
+		// The connection cannot be used for anything else and closing it
+		// is the only way to interrupt a read of the body.
+		resp.Body = &connBody{
+			Reader: resp.Body,
+			c:      t.c,
+		}
+	}
+	return resp, nil
+}
+
+// connBody is the response body of a handshake performed with
+// connTransport. Closing it closes the underlying connection.
+type connBody struct {
+	io.Reader
+	c net.Conn
+}
+
+func (b *connBody) Write(p []byte) (int, error) {
+	return b.c.Write(p)
+}
+
+func (b *connBody) Close() error {
+	return b.c.Close()
+}
+
 func dial(ctx context.Context, urls string, opts *DialOptions, rand io.Reader) (_ *Conn, _ *http.Response, err error) {
 	defer errd.Wrap(&err, "failed to WebSocket dial")
 
@@ -78,25 +406,66 @@ func dial(ctx context.Context, urls string, opts *DialOptions, rand io.Reader) (
 	if opts.HTTPHeader == nil {
 		opts.HTTPHeader = http.Header{}
 	}
+	err = verifyCompressionOptions(opts.CompressionMaxWindowBits, opts.CompressionLevel, opts.CompressionDictionarySize)
+	if err == nil {
+		err = verifyZstdOptions(opts.Zstd)
+	}
+	if err == nil {
+		err = verifyKeepAlive(opts.KeepAlive)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	urls, socketPath, err := parseUnixURL(urls)
+	if err != nil {
+		return nil, nil, err
+	}
+	if socketPath != "" {
+		// The socket path only applies to HTTPClient.
+		opts.HTTP2Client = nil
+		opts.HTTP3Client = nil
+	}
+	if socketPath != "" || opts.netOptions() {
+		opts.HTTPClient = netDialClient(opts, socketPath)
+	}
 
 	secWebSocketKey, err := secWebSocketKey(rand)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to generate Sec-WebSocket-Key: %w", err)
 	}
 
-	var copts *compressionOptions
-	if opts.CompressionMode != CompressionDisabled {
-		copts = opts.CompressionMode.opts()
-	}
+	offers := opts.extensions()
 
-	resp, err := handshakeRequest(ctx, urls, opts, copts, secWebSocketKey)
-	if err != nil {
-		return nil, resp, err
+	var hi HandshakeInfo
+	var resp *http.Response
+	var reqBody *io.PipeWriter
+	if opts.HTTP3Client != nil {
+		resp, reqBody, err = extendedConnectRequest(ctx, &hi, opts.HTTP3Client, 3, urls, opts, offers)
+		if err != nil && !errors.Is(err, errExtendedConnectUnsupported) {
+			return nil, resp, err
+		}
+	}
+	if resp == nil && opts.HTTP2Client != nil {
+		resp, reqBody, err = extendedConnectRequest(ctx, &hi, opts.HTTP2Client, 2, urls, opts, offers)
+		if err != nil && !errors.Is(err, errExtendedConnectUnsupported) {
+			return nil, resp, err
+		}
+	}
+	if resp == nil {
+		resp, err = handshakeRequest(ctx, &hi, urls, opts, offers, secWebSocketKey)
+		if err != nil {
+			return nil, resp, err
+		}
 	}
 	respBody := resp.Body
 	resp.Body = nil
 	defer func() {
 		if err != nil {
+			if reqBody != nil {
+				reqBody.Close()
+			}
+
 			// We read a bit of the body for easier debugging.
 			r := io.LimitReader(respBody, 1024)
 
@@ -111,45 +480,67 @@ func dial(ctx context.Context, urls string, opts *DialOptions, rand io.Reader) (
 		}
 	}()
 
-	copts, err = verifyServerResponse(opts, copts, secWebSocketKey, resp)
-	if err != nil {
-		return nil, resp, err
+	var rwc io.ReadWriteCloser
+	var exts []ExtensionConn
+	if reqBody != nil {
+		exts, err = verifyExtendedConnectResponse(opts, offers, resp)
+		if err != nil {
+			return nil, resp, err
+		}
+
+		rwc = &streamConn{
+			r:          respBody,
+			w:          reqBody,
+			closeWrite: reqBody.Close,
+		}
+	} else {
+		exts, err = verifyServerResponse(opts, offers, secWebSocketKey, resp)
+		if err != nil {
+			return nil, resp, err
+		}
+
+		var ok bool
+		rwc, ok = respBody.(io.ReadWriteCloser)
+		if !ok {
+			closeExtensions(exts)
+			return nil, resp, fmt.Errorf("response body is not a io.ReadWriteCloser: %T", respBody)
+		}
 	}
 
-	rwc, ok := respBody.(io.ReadWriteCloser)
-	if !ok {
-		return nil, resp, fmt.Errorf("response body is not a io.ReadWriteCloser: %T", respBody)
+	hi.ResponseHeader = resp.Header.Clone()
+	hi.TLS = resp.TLS
+	if nc, ok := respBody.(net.Conn); ok && hi.LocalAddr == nil {
+		hi.LocalAddr = nc.LocalAddr()
+		hi.RemoteAddr = nc.RemoteAddr()
 	}
 
 	return newConn(connConfig{
-		subprotocol:    resp.Header.Get("Sec-WebSocket-Protocol"),
-		rwc:            rwc,
-		client:         true,
-		copts:          copts,
-		flateThreshold: opts.CompressionThreshold,
-		br:             getBufioReader(rwc),
-		bw:             getBufioWriter(rwc),
+		subprotocol: resp.Header.Get("Sec-WebSocket-Protocol"),
+		rwc:         rwc,
+		client:      true,
+		exts:        exts,
+		handshake:   hi,
+
+		controlTimeout: opts.ControlTimeout,
+		closeTimeout:   opts.CloseTimeout,
+		keepAlive:      opts.KeepAlive,
+		onPing:         opts.OnPing,
+		onPong:         opts.OnPong,
+		halfClose:      opts.HalfClose,
+
+		br: getBufioReader(rwc),
+		bw: getBufioWriter(rwc),
 	}), resp, nil
 }
 
-func handshakeRequest(ctx context.Context, urls string, opts *DialOptions, copts *compressionOptions, secWebSocketKey string) (*http.Response, error) {
+func handshakeRequest(ctx context.Context, hi *HandshakeInfo, urls string, opts *DialOptions, offers []Extension, secWebSocketKey string) (*http.Response, error) {
 	if opts.HTTPClient.Timeout > 0 {
 		return nil, errors.New("use context for cancellation instead of http.Client.Timeout; see https://github.com/nhooyr/websocket/issues/67")
 	}
 
-	u, err := url.Parse(urls)
+	u, err := parseURL(urls)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse url: %w", err)
-	}
-
-	switch u.Scheme {
-	case "ws":
-		u.Scheme = "http"
-	case "wss":
-		u.Scheme = "https"
-	case "http", "https":
-	default:
-		return nil, fmt.Errorf("unexpected url scheme: %q", u.Scheme)
+		return nil, err
 	}
 
 	req, _ := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
@@ -161,9 +552,8 @@ func handshakeRequest(ctx context.Context, urls string, opts *DialOptions, copts
 	if len(opts.Subprotocols) > 0 {
 		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(opts.Subprotocols, ","))
 	}
-	if copts != nil {
-		copts.setHeader(req.Header)
-	}
+	offerExtensions(req.Header, offers)
+	req = traceHandshake(req, hi)
 
 	resp, err := opts.HTTPClient.Do(req)
 	if err != nil {
@@ -172,6 +562,330 @@ func handshakeRequest(ctx context.Context, urls string, opts *DialOptions, copts
 	return resp, nil
 }
 
+// traceHandshake records the headers of req and the addresses
+// of the connection it is sent on in hi.
+func traceHandshake(req *http.Request, hi *HandshakeInfo) *http.Request {
+	hi.RequestHeader = req.Header.Clone()
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			hi.LocalAddr = info.Conn.LocalAddr()
+			hi.RemoteAddr = info.Conn.RemoteAddr()
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+var errExtendedConnectUnsupported = errors.New("server does not support extended CONNECT")
+
+func extendedConnectRequest(ctx context.Context, hi *HandshakeInfo, hc *http.Client, protoMajor int, urls string, opts *DialOptions, offers []Extension) (*http.Response, *io.PipeWriter, error) {
+	if hc.Timeout > 0 {
+		return nil, nil, errors.New("use context for cancellation instead of http.Client.Timeout; see https://github.com/nhooyr/websocket/issues/67")
+	}
+
+	u, err := parseURL(urls)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequestWithContext(ctx, "CONNECT", u.String(), pr)
+	req.Header = opts.HTTPHeader.Clone()
+	if protoMajor >= 3 {
+		// http3.Transport sends Proto as :protocol for CONNECT requests.
+		req.Proto = "websocket"
+	} else {
+		req.Header.Set(":protocol", "websocket")
+	}
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if len(opts.Subprotocols) > 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(opts.Subprotocols, ","))
+	}
+	offerExtensions(req.Header, offers)
+	req = traceHandshake(req, hi)
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		pw.Close()
+		if isExtendedConnectUnsupported(err) {
+			return nil, nil, errExtendedConnectUnsupported
+		}
+		return nil, nil, fmt.Errorf("failed to send handshake request: %w", err)
+	}
+	return resp, pw, nil
+}
+
+// isExtendedConnectUnsupported reports whether err is due to the server
+// not advertising SETTINGS_ENABLE_CONNECT_PROTOCOL.
+//
+// Neither net/http, golang.org/x/net/http2 nor github.com/quic-go/quic-go/http3
+// export their errors for it so they are matched by message.
+func isExtendedConnectUnsupported(err error) bool {
+	s := err.Error()
+	return strings.Contains(s, "net/http: extended connect not supported by peer") ||
+		strings.Contains(s, "http3: server didn't enable Extended CONNECT")
+}
+
+func (opts *DialOptions) netOptions() bool {
+	return opts.NetDialContext != nil ||
+		opts.Proxy != nil ||
+		opts.DisableTCPNoDelay ||
+		opts.TCPKeepAlive != 0 ||
+		opts.SocketReadBufferSize != 0 ||
+		opts.SocketWriteBufferSize != 0
+}
+
+// netDialClient returns a copy of opts.HTTPClient whose handshake requests
+// are sent on connections dialed by netTransport. The caller's Transport is
+// neither modified nor used to send the request.
+func netDialClient(opts *DialOptions, socketPath string) *http.Client {
+	t := &netTransport{
+		opts:        opts,
+		socketPath:  socketPath,
+		dialContext: opts.NetDialContext,
+		proxy:       opts.Proxy,
+	}
+
+	rt := opts.HTTPClient.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if ht, ok := rt.(*http.Transport); ok {
+		if t.dialContext == nil {
+			t.dialContext = ht.DialContext
+		}
+		if t.proxy == nil {
+			t.proxy = ht.Proxy
+		}
+		t.tlsConfig = ht.TLSClientConfig
+	}
+	if t.dialContext == nil {
+		t.dialContext = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	if socketPath != "" {
+		// Unix sockets are never proxied.
+		t.proxy = nil
+	}
+
+	hc := *opts.HTTPClient
+	hc.Transport = t
+	return &hc
+}
+
+// netTransport is the http.RoundTripper that Dial uses when any of
+// NetDialContext, Proxy, the socket options or a Unix socket URL are set.
+// It dials a connection for every request, applies the socket options,
+// tunnels through the proxy, secures it with TLS for https and then sends
+// the request on it with connTransport.
+//
+// If the caller's Transport is an *http.Transport, its DialContext, Proxy
+// and TLSClientConfig are used as the defaults.
+type netTransport struct {
+	opts        *DialOptions
+	socketPath  string
+	dialContext dialFunc
+	proxy       func(*http.Request) (*url.URL, error)
+	tlsConfig   *tls.Config
+}
+
+func (t *netTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c, err := t.dial(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&connTransport{c: c}).RoundTrip(req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (t *netTransport) dial(req *http.Request) (net.Conn, error) {
+	ctx := req.Context()
+
+	var proxyURL *url.URL
+	if t.proxy != nil {
+		var err error
+		proxyURL, err = t.proxy(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get proxy for %v: %w", req.URL, err)
+		}
+		if proxyURL != nil {
+			switch proxyURL.Scheme {
+			case "http", "https", "socks5", "socks5h":
+			default:
+				return nil, fmt.Errorf("unsupported proxy scheme: %q", proxyURL.Scheme)
+			}
+		}
+	}
+
+	addr := canonicalAddr(req.URL)
+	var c net.Conn
+	var err error
+	switch {
+	case t.socketPath != "":
+		c, err = t.netDial(ctx, "unix", t.socketPath)
+	case proxyURL != nil:
+		c, err = dialProxy(ctx, t.netDial, t.tlsConfig, proxyURL, "tcp", addr)
+	default:
+		c, err = t.netDial(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if req.URL.Scheme == "https" {
+		cfg := &tls.Config{}
+		if t.tlsConfig != nil {
+			cfg = t.tlsConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = req.URL.Hostname()
+		}
+		// The connection is upgraded so only HTTP/1.1 may be negotiated.
+		cfg.NextProtos = nil
+		tc := tls.Client(c, cfg)
+		err = tc.HandshakeContext(ctx)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		c = tc
+	}
+	return c, nil
+}
+
+func (t *netTransport) netDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := t.dialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	err = setSocketOptions(c, t.opts)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// canonicalAddr returns the host:port of u with the port defaulted
+// from its scheme.
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func setSocketOptions(c net.Conn, opts *DialOptions) error {
+	if tc, ok := c.(*net.TCPConn); ok {
+		if opts.DisableTCPNoDelay {
+			err := tc.SetNoDelay(false)
+			if err != nil {
+				return fmt.Errorf("failed to disable TCP_NODELAY: %w", err)
+			}
+		}
+		if opts.TCPKeepAlive < 0 {
+			err := tc.SetKeepAlive(false)
+			if err != nil {
+				return fmt.Errorf("failed to disable TCP keep alive: %w", err)
+			}
+		} else if opts.TCPKeepAlive > 0 {
+			err := tc.SetKeepAlive(true)
+			if err == nil {
+				err = tc.SetKeepAlivePeriod(opts.TCPKeepAlive)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to set TCP keep alive period: %w", err)
+			}
+		}
+	}
+
+	bc, ok := c.(interface {
+		SetReadBuffer(int) error
+		SetWriteBuffer(int) error
+	})
+	if !ok {
+		if opts.SocketReadBufferSize != 0 || opts.SocketWriteBufferSize != 0 {
+			return fmt.Errorf("cannot set socket buffer sizes on %T", c)
+		}
+		return nil
+	}
+	if opts.SocketReadBufferSize != 0 {
+		err := bc.SetReadBuffer(opts.SocketReadBufferSize)
+		if err != nil {
+			return fmt.Errorf("failed to set socket read buffer size: %w", err)
+		}
+	}
+	if opts.SocketWriteBufferSize != 0 {
+		err := bc.SetWriteBuffer(opts.SocketWriteBufferSize)
+		if err != nil {
+			return fmt.Errorf("failed to set socket write buffer size: %w", err)
+		}
+	}
+	return nil
+}
+
+// parseUnixURL rewrites ws+unix and wss+unix URLs into ws and wss URLs
+// and returns the socket path separately. Other URLs are returned as is.
+func parseUnixURL(urls string) (_ string, socketPath string, _ error) {
+	u, err := url.Parse(urls)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "ws+unix":
+		u.Scheme = "ws"
+	case "wss+unix":
+		u.Scheme = "wss"
+	default:
+		return urls, "", nil
+	}
+
+	socketPath = u.Path
+	u.Path = "/"
+	if i := strings.Index(socketPath, ":"); i >= 0 {
+		socketPath, u.Path = socketPath[:i], socketPath[i+1:]
+		u.RawPath = ""
+	}
+	if socketPath == "" {
+		return "", "", fmt.Errorf("missing Unix socket path in url: %q", urls)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	if u.Host == "" {
+		u.Host = "localhost"
+	}
+	return u.String(), socketPath, nil
+}
+
+func parseURL(urls string) (*url.URL, error) {
+	u, err := url.Parse(urls)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unexpected url scheme: %q", u.Scheme)
+	}
+	return u, nil
+}
+
 func secWebSocketKey(rr io.Reader) (string, error) {
 	if rr == nil {
 		rr = rand.Reader
@@ -184,7 +898,7 @@ func secWebSocketKey(rr io.Reader) (string, error) {
 	return base64.StdEncoding.EncodeToString(b), nil
 }
 
-func verifyServerResponse(opts *DialOptions, copts *compressionOptions, secWebSocketKey string, resp *http.Response) (*compressionOptions, error) {
+func verifyServerResponse(opts *DialOptions, offers []Extension, secWebSocketKey string, resp *http.Response) ([]ExtensionConn, error) {
 	if resp.StatusCode != http.StatusSwitchingProtocols {
 		return nil, fmt.Errorf("expected handshake response status code %v but got %v", http.StatusSwitchingProtocols, resp.StatusCode)
 	}
@@ -209,7 +923,21 @@ func verifyServerResponse(opts *DialOptions, copts *compressionOptions, secWebSo
 		return nil, err
 	}
 
-	return verifyServerExtensions(copts, resp.Header)
+	return verifyServerExtensions(offers, resp.Header)
+}
+
+// See https://tools.ietf.org/html/rfc8441#section-5 and https://tools.ietf.org/html/rfc9220#section-3
+func verifyExtendedConnectResponse(opts *DialOptions, offers []Extension, resp *http.Response) ([]ExtensionConn, error) {
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("expected extended CONNECT response status code %v but got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	err := verifySubprotocol(opts.Subprotocols, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return verifyServerExtensions(offers, resp.Header)
 }
 
 func verifySubprotocol(subprotos []string, resp *http.Response) error {
@@ -227,35 +955,6 @@ func verifySubprotocol(subprotos []string, resp *http.Response) error {
 	return fmt.Errorf("WebSocket protocol violation: unexpected Sec-WebSocket-Protocol from server: %q", proto)
 }
 
-func verifyServerExtensions(copts *compressionOptions, h http.Header) (*compressionOptions, error) {
-	exts := websocketExtensions(h)
-	if len(exts) == 0 {
-		return nil, nil
-	}
-
-	ext := exts[0]
-	if ext.name != "permessage-deflate" || len(exts) > 1 || copts == nil {
-		return nil, fmt.Errorf("WebSocket protcol violation: unsupported extensions from server: %+v", exts[1:])
-	}
-
-	copts = &*copts
-
-	for _, p := range ext.params {
-		switch p {
-		case "client_no_context_takeover":
-			copts.clientNoContextTakeover = true
-			continue
-		case "server_no_context_takeover":
-			copts.serverNoContextTakeover = true
-			continue
-		}
-
-		return nil, fmt.Errorf("unsupported permessage-deflate parameter: %q", p)
-	}
-
-	return copts, nil
-}
-
 var bufioReaderPool sync.Pool
 
 func getBufioReader(r io.Reader) *bufio.Reader {
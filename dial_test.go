@@ -3,12 +3,18 @@
 package websocket
 
 import (
+	"bufio"
 	"context"
 	"crypto/rand"
+	"errors"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -45,6 +51,57 @@ func TestBadDials(t *testing.T) {
 					},
 				},
 			},
+			{
+				name: "badUnixURL",
+				url:  "ws+unix://localhost",
+			},
+			{
+				name: "badCompressionMaxWindowBits",
+				url:  "ws://nhooyr.io",
+				opts: &DialOptions{
+					CompressionMaxWindowBits: 16,
+				},
+			},
+			{
+				name: "badCompressionLevel",
+				url:  "ws://nhooyr.io",
+				opts: &DialOptions{
+					CompressionLevel: 10,
+				},
+			},
+			{
+				name: "badCompressionDictionarySize",
+				url:  "ws://nhooyr.io",
+				opts: &DialOptions{
+					CompressionDictionarySize: 65536,
+				},
+			},
+			{
+				name: "badZstdLevel",
+				url:  "ws://nhooyr.io",
+				opts: &DialOptions{
+					Zstd: &ZstdOptions{
+						Level: 23,
+					},
+				},
+			},
+			{
+				name: "badKeepAlive",
+				url:  "ws://nhooyr.io",
+				opts: &DialOptions{
+					KeepAlive: &KeepAlive{},
+				},
+			},
+			{
+				name: "badNetDialTransport",
+				url:  "ws://nhooyr.io",
+				opts: &DialOptions{
+					HTTPClient: mockHTTPClient(func(*http.Request) (*http.Response, error) {
+						return nil, errors.New("unreachable")
+					}),
+					NetDialContext: (&net.Dialer{}).DialContext,
+				},
+			},
 			{
 				name: "badTLS",
 				url:  "wss://totallyfake.nhooyr.io",
@@ -117,6 +174,304 @@ func TestBadDials(t *testing.T) {
 	})
 }
 
+func TestDialHTTP3Fallback(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(echoOnceHandler(t))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	c, resp, err := Dial(ctx, s.URL, &DialOptions{
+		// quic-go/http3 servers always enable extended CONNECT so the
+		// error its client returns for servers that do not is mocked.
+		HTTP3Client: mockHTTPClient(func(r *http.Request) (*http.Response, error) {
+			return nil, errors.New("http3: server didn't enable Extended CONNECT")
+		}),
+		Subprotocols: []string{"echo"},
+	})
+	assert.Success(t, err)
+	assert.Equal(t, "status code", http.StatusSwitchingProtocols, resp.StatusCode)
+
+	assertEcho(ctx, t, c)
+}
+
+func TestDialUnix(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "websocket")
+	assert.Success(t, err)
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "ws.sock")
+	l, err := net.Listen("unix", socketPath)
+	assert.Success(t, err)
+
+	echo := echoOnceHandler(t)
+	s := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/chat" || r.URL.RawQuery != "room=1" || r.Host != "localhost" {
+				t.Errorf("unexpected request: %v %v", r.Host, r.URL)
+			}
+			echo.ServeHTTP(w, r)
+		}),
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	c, _, err := Dial(ctx, "ws+unix://"+socketPath+":/chat?room=1", &DialOptions{
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy: func(r *http.Request) (*url.URL, error) {
+					t.Errorf("unexpected proxy lookup for %v", r.URL)
+					return nil, nil
+				},
+			},
+		},
+		Subprotocols:          []string{"echo"},
+		SocketReadBufferSize:  1 << 16,
+		SocketWriteBufferSize: 1 << 16,
+	})
+	assert.Success(t, err)
+
+	assertEcho(ctx, t, c)
+}
+
+func TestDialNetDialContext(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(echoOnceHandler(t))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	var dials []string
+	c, _, err := Dial(ctx, s.URL, &DialOptions{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials = append(dials, network+" "+addr)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+		DisableTCPNoDelay:     true,
+		TCPKeepAlive:          time.Minute,
+		SocketReadBufferSize:  1 << 16,
+		SocketWriteBufferSize: 1 << 16,
+		Subprotocols:          []string{"echo"},
+	})
+	assert.Success(t, err)
+	assert.Equal(t, "dials", []string{"tcp " + s.Listener.Addr().String()}, dials)
+
+	assertEcho(ctx, t, c)
+}
+
+func Test_parseUnixURL(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name       string
+		url        string
+		expURL     string
+		socketPath string
+		success    bool
+	}{
+		{
+			name:    "notUnix",
+			url:     "wss://example.com/chat",
+			expURL:  "wss://example.com/chat",
+			success: true,
+		},
+		{
+			name:       "noPath",
+			url:        "ws+unix:///tmp/ws.sock",
+			expURL:     "ws://localhost/",
+			socketPath: "/tmp/ws.sock",
+			success:    true,
+		},
+		{
+			name:       "path",
+			url:        "wss+unix://example.com/tmp/ws.sock:/chat?room=1",
+			expURL:     "wss://example.com/chat?room=1",
+			socketPath: "/tmp/ws.sock",
+			success:    true,
+		},
+		{
+			name: "noSocketPath",
+			url:  "ws+unix://localhost",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			u, socketPath, err := parseUnixURL(tc.url)
+			if !tc.success {
+				assert.Error(t, err)
+				return
+			}
+			assert.Success(t, err)
+			assert.Equal(t, "url", tc.expURL, u)
+			assert.Equal(t, "socket path", tc.socketPath, socketPath)
+		})
+	}
+}
+
+func TestHandshakeInfo(t *testing.T) {
+	t.Parallel()
+
+	serverInfo := make(chan HandshakeInfo, 1)
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Accept(w, r, &AcceptOptions{
+			Subprotocols:    []string{"echo"},
+			CompressionMode: CompressionContextTakeover,
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close(StatusInternalError, "")
+
+		serverInfo <- c.HandshakeInfo()
+		c.Close(StatusNormalClosure, "")
+	}))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	h := http.Header{}
+	h.Set("X-Test", "meow")
+	c, _, err := Dial(ctx, s.URL, &DialOptions{
+		HTTPClient:      s.Client(),
+		HTTPHeader:      h,
+		Subprotocols:    []string{"echo"},
+		CompressionMode: CompressionContextTakeover,
+	})
+	assert.Success(t, err)
+	defer c.Close(StatusInternalError, "")
+
+	si := <-serverInfo
+	ci := c.HandshakeInfo()
+
+	for _, hi := range []HandshakeInfo{si, ci} {
+		assert.Equal(t, "request header", "meow", hi.RequestHeader.Get("X-Test"))
+		assert.Equal(t, "response subprotocol", "echo", hi.ResponseHeader.Get("Sec-WebSocket-Protocol"))
+		assert.Equal(t, "compression", &CompressionInfo{
+			ClientMaxWindowBits: 15,
+			ServerMaxWindowBits: 15,
+		}, hi.Compression)
+		if hi.TLS == nil || !hi.TLS.HandshakeComplete {
+			t.Fatalf("expected TLS connection state: %+v", hi.TLS)
+		}
+	}
+	assert.Equal(t, "client local address", si.RemoteAddr.String(), ci.LocalAddr.String())
+	assert.Equal(t, "client remote address", si.LocalAddr.String(), ci.RemoteAddr.String())
+	assert.Equal(t, "server local address", s.Listener.Addr().String(), si.LocalAddr.String())
+}
+
+func TestClientHandshake(t *testing.T) {
+	t.Parallel()
+
+	t.Run("badServerHandshake", func(t *testing.T) {
+		t.Parallel()
+
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		go func() {
+			br := bufio.NewReader(c2)
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp := &http.Response{
+				StatusCode:    http.StatusOK,
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Request:       req,
+				Body:          ioutil.NopCloser(strings.NewReader("not a WebSocket")),
+				ContentLength: int64(len("not a WebSocket")),
+			}
+			resp.Write(c2)
+		}()
+
+		_, resp, err := ClientHandshake(ctx, c1, "ws://example.com", nil)
+		assert.Contains(t, err, "expected handshake response status code 101 but got 200")
+		assert.Equal(t, "status code", http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("contextExpired", func(t *testing.T) {
+		t.Parallel()
+
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+
+		_, _, err := ClientHandshake(ctx, c1, "ws://example.com", nil)
+		assert.Error(t, err)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected context.DeadlineExceeded: %v", err)
+		}
+	})
+}
+
+// echoOnceHandler echoes a single message on every WebSocket
+// and then closes it.
+func echoOnceHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Accept(w, r, &AcceptOptions{
+			Subprotocols: []string{"echo"},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close(StatusInternalError, "")
+
+		typ, p, err := c.Read(r.Context())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		err = c.Write(r.Context(), typ, p)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		c.Close(StatusNormalClosure, "")
+	})
+}
+
+func assertEcho(ctx context.Context, t *testing.T, c *Conn) {
+	t.Helper()
+	defer c.Close(StatusInternalError, "")
+
+	msg := []byte(strings.Repeat("hello", 128))
+	err := c.Write(ctx, MessageText, msg)
+	assert.Success(t, err)
+
+	typ, p, err := c.Read(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "type", MessageText, typ)
+	assert.Equal(t, "msg", msg, p)
+
+	_, _, err = c.Read(ctx)
+	assert.Equal(t, "close status", StatusNormalClosure, CloseStatus(err))
+}
+
 func Test_verifyServerHandshake(t *testing.T) {
 	t.Parallel()
 
@@ -189,6 +544,26 @@ func Test_verifyServerHandshake(t *testing.T) {
 			},
 			success: false,
 		},
+		{
+			name: "deflateWindowBits",
+			response: func(w http.ResponseWriter) {
+				w.Header().Set("Connection", "Upgrade")
+				w.Header().Set("Upgrade", "websocket")
+				w.Header().Set("Sec-WebSocket-Extensions", "permessage-deflate; client_max_window_bits=9; server_max_window_bits=10")
+				w.WriteHeader(http.StatusSwitchingProtocols)
+			},
+			success: true,
+		},
+		{
+			name: "badDeflateWindowBits",
+			response: func(w http.ResponseWriter) {
+				w.Header().Set("Connection", "Upgrade")
+				w.Header().Set("Upgrade", "websocket")
+				w.Header().Set("Sec-WebSocket-Extensions", "permessage-deflate; server_max_window_bits=7")
+				w.WriteHeader(http.StatusSwitchingProtocols)
+			},
+			success: false,
+		},
 		{
 			name: "success",
 			response: func(w http.ResponseWriter) {
@@ -221,7 +596,7 @@ func Test_verifyServerHandshake(t *testing.T) {
 			opts := &DialOptions{
 				Subprotocols: strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ","),
 			}
-			_, err = verifyServerResponse(opts, opts.CompressionMode.opts(), key, resp)
+			_, err = verifyServerResponse(opts, opts.extensions(), key, resp)
 			if tc.success {
 				assert.Success(t, err)
 			} else {
@@ -20,3 +20,20 @@ func (c *Conn) RecordBytesRead() *int {
 	}))
 	return &bytesRead
 }
+
+// DiscardWrites makes c drop everything it writes
+// as if the peer stopped receiving.
+func (c *Conn) DiscardWrites() {
+	c.bw.Reset(writerFunc(func(p []byte) (int, error) {
+		return len(p), nil
+	}))
+}
+
+// OnWrite makes c call f after each write reaches the peer.
+func (c *Conn) OnWrite(f func()) {
+	c.bw.Reset(writerFunc(func(p []byte) (int, error) {
+		n, err := c.rwc.Write(p)
+		f()
+		return n, err
+	}))
+}
@@ -0,0 +1,421 @@
+// +build !js
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Extension represents a WebSocket extension negotiated with the
+// Sec-WebSocket-Extensions header.
+// See https://tools.ietf.org/html/rfc6455#section-9
+//
+// permessage-deflate is implemented as an Extension configured with
+// the CompressionMode and CompressionThreshold options and the experimental
+// permessage-zstd with the Zstd option.
+//
+// Parameters are in the form name or name=value and lower case.
+type Extension interface {
+	// Name returns the extension token such as permessage-deflate.
+	Name() string
+
+	// Offer returns the parameters the client offers the extension with.
+	Offer() []string
+
+	// Accept is called by the server with the parameters of an offer from the client.
+	// It returns the state of the extension for the connection and the parameters
+	// to respond with. A nil ExtensionConn and error declines the offer.
+	// An error fails the handshake with 400 Bad Request.
+	Accept(params []string) (ExtensionConn, []string, error)
+
+	// Negotiated is called by the client with the parameters the server accepted
+	// the offer with. An error fails the handshake.
+	Negotiated(params []string) (ExtensionConn, error)
+}
+
+// ExtensionConn is the state of an Extension negotiated for a connection.
+//
+// It may implement MessageTransformer and FrameTransformer to transform
+// data messages and frames and FrameHandler to handle frames with
+// reserved opcodes.
+//
+// Methods used for reading may be called concurrently with
+// methods used for writing but never with themselves.
+type ExtensionConn interface {
+	// RSV returns the reserved bits the extension sets on frames.
+	// Extensions negotiated on the same connection cannot share bits.
+	// Frames received with bits not owned by a negotiated extension
+	// fail the connection with StatusProtocolError.
+	RSV() RSV
+
+	// Close is called once the connection is closed to release
+	// the extension's resources.
+	Close() error
+}
+
+// RSV represents the reserved bits of a frame header.
+type RSV uint8
+
+// Reserved bits in the order they appear in the frame header.
+const (
+	RSV1 RSV = 1 << (2 - iota)
+	RSV2
+	RSV3
+)
+
+// MessageTransformer is implemented by an ExtensionConn that transforms
+// the payload of entire data messages such as permessage-deflate.
+// Its reserved bits may only be set on the first frame of a message.
+//
+// Transformers are applied to written messages in the order the extensions
+// were negotiated and in reverse to read messages.
+type MessageTransformer interface {
+	// WriteMessage is called when a message is first written to.
+	// sizeHint is the length of the first write which for Conn.Write is
+	// the entire message.
+	//
+	// It returns a writer that transforms what is written to it
+	// into w and the reserved bits to set on the first frame.
+	// The writer is closed once the message is complete.
+	// A nil writer leaves the message as is.
+	WriteMessage(w io.Writer, typ MessageType, sizeHint int) (io.WriteCloser, RSV, error)
+
+	// ReadMessage is called at the start of every message read with the
+	// reserved bits of its first frame. It returns a reader that reverses
+	// the transform of r. Return r to leave the message as is.
+	//
+	// The returned reader must return io.EOF once r does.
+	ReadMessage(r io.Reader, typ MessageType, rsv RSV) (io.Reader, error)
+}
+
+// FrameTransformer is implemented by an ExtensionConn that transforms
+// the payload of every data frame.
+//
+// Transformers are applied to written frames in the order the extensions
+// were negotiated and in reverse to read frames.
+type FrameTransformer interface {
+	// WriteFrame returns the payload to write in place of p and
+	// the reserved bits to set on the frame.
+	// fin reports whether the frame is the last of its message.
+	// p must not be retained.
+	WriteFrame(p []byte, fin bool) ([]byte, RSV, error)
+
+	// ReadFrame returns the original payload of a frame read
+	// with the reserved bits rsv. p may be modified in place
+	// and must not be retained.
+	ReadFrame(p []byte, rsv RSV, fin bool) ([]byte, error)
+}
+
+// FrameHandler is implemented by an ExtensionConn that defines frames with
+// reserved opcodes. See https://tools.ietf.org/html/rfc6455#section-5.2
+//
+// Like control frames, frames with reserved opcodes cannot be fragmented
+// and may be received in the middle of a fragmented message.
+type FrameHandler interface {
+	// Opcodes returns the reserved opcodes handled.
+	// 3-7 are reserved for non control frames and 11-15 for control frames.
+	Opcodes() []int
+
+	// HandleFrame is called from the goroutine reading from c with
+	// the unmasked payload of every frame with one of Opcodes.
+	// It must not read from c.
+	//
+	// An error fails the connection with StatusProtocolError.
+	HandleFrame(ctx context.Context, c *Conn, opcode int, p []byte) error
+}
+
+// WriteExtensionFrame writes a frame with a reserved opcode handled by
+// a negotiated extension's FrameHandler.
+func (c *Conn) WriteExtensionFrame(ctx context.Context, op int, p []byte) error {
+	if _, ok := c.frameHandlers[opcode(op)]; !ok {
+		return fmt.Errorf("failed to write extension frame: opcode %v not handled by a negotiated extension", op)
+	}
+	if isControlOpcode(opcode(op)) && len(p) > maxControlPayload {
+		return fmt.Errorf("failed to write extension frame: control frame payload too large: %v", len(p))
+	}
+
+	_, err := c.writeFrame(ctx, true, 0, opcode(op), p)
+	if err != nil {
+		return fmt.Errorf("failed to write extension frame %v: %w", op, err)
+	}
+	return nil
+}
+
+func isControlOpcode(op opcode) bool {
+	return op >= opClose
+}
+
+func isReservedOpcode(op opcode) bool {
+	return op > opBinary && op < opClose || op > opPong && op <= 15
+}
+
+// connInitializer is implemented by the built in ExtensionConns
+// that need the Conn they are used by.
+type connInitializer interface {
+	initConn(c *Conn)
+}
+
+func (c *Conn) initExtensions(exts []ExtensionConn) {
+	c.exts = exts
+	for _, ec := range exts {
+		if ci, ok := ec.(connInitializer); ok {
+			ci.initConn(c)
+		}
+
+		mt, isMsg := ec.(MessageTransformer)
+		if isMsg {
+			c.msgTransformers = append(c.msgTransformers, mt)
+			c.msgRSV |= ec.RSV()
+		}
+		ft, isFrame := ec.(FrameTransformer)
+		if isFrame {
+			c.frameTransformers = append(c.frameTransformers, ft)
+		}
+		if isFrame || !isMsg {
+			// Extensions that do not transform messages
+			// may set their bits on any data frame.
+			c.frameRSV |= ec.RSV()
+		}
+		if fh, ok := ec.(FrameHandler); ok {
+			if c.frameHandlers == nil {
+				c.frameHandlers = make(map[opcode]ExtensionConn)
+			}
+			for _, op := range fh.Opcodes() {
+				c.frameHandlers[opcode(op)] = ec
+			}
+		}
+	}
+}
+
+func (c *Conn) closeExtensions() {
+	closeExtensions(c.exts)
+}
+
+func closeExtensions(exts []ExtensionConn) {
+	for _, ec := range exts {
+		ec.Close()
+	}
+}
+
+// checkRSV returns an error if the reserved bits of h are not
+// owned by a negotiated extension for the frame's opcode.
+func (c *Conn) checkRSV(h header) error {
+	rsv := h.rsv()
+	if rsv == 0 {
+		return nil
+	}
+
+	var allowed RSV
+	switch h.opcode {
+	case opText, opBinary:
+		allowed = c.msgRSV | c.frameRSV
+	case opContinuation:
+		allowed = c.frameRSV
+	default:
+		if ec, ok := c.frameHandlers[h.opcode]; ok {
+			allowed = ec.RSV()
+		}
+	}
+
+	if rsv&^allowed != 0 {
+		return fmt.Errorf("received header with unexpected rsv bits set: %v:%v:%v", h.rsv1, h.rsv2, h.rsv3)
+	}
+	return nil
+}
+
+func (c *Conn) handleExtensionFrame(ctx context.Context, h header, ec ExtensionConn) error {
+	if !h.fin {
+		err := fmt.Errorf("received fragmented frame with reserved opcode %v", h.opcode)
+		c.writeError(StatusProtocolError, err)
+		return err
+	}
+
+	if isControlOpcode(h.opcode) && h.payloadLength > maxControlPayload {
+		err := fmt.Errorf("received control frame payload with invalid length: %d", h.payloadLength)
+		c.writeError(StatusProtocolError, err)
+		return err
+	}
+	if limit := c.msgReader.limitReader.limit.Load(); h.payloadLength > limit {
+		err := ReadLimitError{Limit: ReadLimitMessage, Max: limit - 1}
+		c.writeError(StatusMessageTooBig, err)
+		return err
+	}
+
+	b := make([]byte, h.payloadLength)
+	_, err := c.readFramePayload(ctx, b)
+	if err != nil {
+		return err
+	}
+
+	if h.masked {
+		mask(h.maskKey, b)
+	}
+
+	err = ec.(FrameHandler).HandleFrame(ctx, c, int(h.opcode), b)
+	if err != nil {
+		err = fmt.Errorf("failed to handle frame %v: %w", h.opcode, err)
+		c.writeError(StatusProtocolError, err)
+		return err
+	}
+	return nil
+}
+
+// checkExtension returns an error if ec cannot be negotiated
+// alongside exts.
+func checkExtension(exts []ExtensionConn, ec ExtensionConn) error {
+	var opcodes []int
+	if fh, ok := ec.(FrameHandler); ok {
+		opcodes = fh.Opcodes()
+		for _, op := range opcodes {
+			if !isReservedOpcode(opcode(op)) {
+				return fmt.Errorf("extension handles opcode %v that is not reserved", op)
+			}
+		}
+	}
+
+	for _, ec2 := range exts {
+		if ec.RSV()&ec2.RSV() != 0 {
+			return errors.New("extensions cannot share rsv bits")
+		}
+		if fh, ok := ec2.(FrameHandler); ok {
+			for _, op := range fh.Opcodes() {
+				for _, op2 := range opcodes {
+					if op == op2 {
+						return fmt.Errorf("extensions cannot share opcode %v", op)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func findExtension(exts []Extension, name string) Extension {
+	for _, ext := range exts {
+		if strings.EqualFold(ext.Name(), name) {
+			return ext
+		}
+	}
+	return nil
+}
+
+func formatExtension(name string, params []string) string {
+	if len(params) == 0 {
+		return name
+	}
+	return name + "; " + strings.Join(params, "; ")
+}
+
+func offerExtensions(h http.Header, exts []Extension) {
+	if len(exts) == 0 {
+		return
+	}
+
+	offers := make([]string, len(exts))
+	for i, ext := range exts {
+		offers[i] = formatExtension(ext.Name(), ext.Offer())
+	}
+	h.Set("Sec-WebSocket-Extensions", strings.Join(offers, ", "))
+}
+
+func acceptExtensions(r *http.Request, w http.ResponseWriter, exts []Extension) ([]ExtensionConn, error) {
+	if len(exts) == 0 {
+		return nil, nil
+	}
+
+	var ecs []ExtensionConn
+	var names []string
+	var accepted []string
+	for _, offer := range websocketExtensions(r.Header) {
+		ext := findExtension(exts, offer.name)
+		if ext == nil || containsFold(names, offer.name) {
+			continue
+		}
+
+		ec, params, err := ext.Accept(offer.params)
+		if err != nil {
+			closeExtensions(ecs)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, err
+		}
+		if ec == nil {
+			continue
+		}
+		if checkExtension(ecs, ec) != nil {
+			// Decline the offer in favour of those already accepted.
+			ec.Close()
+			continue
+		}
+
+		ecs = append(ecs, ec)
+		names = append(names, offer.name)
+		accepted = append(accepted, formatExtension(ext.Name(), params))
+	}
+
+	if len(accepted) > 0 {
+		w.Header().Set("Sec-WebSocket-Extensions", strings.Join(accepted, ", "))
+	}
+	return ecs, nil
+}
+
+func verifyServerExtensions(exts []Extension, h http.Header) (_ []ExtensionConn, err error) {
+	var ecs []ExtensionConn
+	defer func() {
+		if err != nil {
+			closeExtensions(ecs)
+		}
+	}()
+
+	var names []string
+	for _, resp := range websocketExtensions(h) {
+		ext := findExtension(exts, resp.name)
+		if ext == nil || containsFold(names, resp.name) {
+			return nil, fmt.Errorf("WebSocket protocol violation: unsupported extension from server: %q", resp.name)
+		}
+
+		ec, err := ext.Negotiated(resp.params)
+		if err != nil {
+			return nil, err
+		}
+		if ec == nil {
+			return nil, fmt.Errorf("extension %v declined server response", resp.name)
+		}
+		err = checkExtension(ecs, ec)
+		if err != nil {
+			ec.Close()
+			return nil, fmt.Errorf("WebSocket protocol violation: %w", err)
+		}
+
+		ecs = append(ecs, ec)
+		names = append(names, resp.name)
+	}
+	return ecs, nil
+}
+
+func containsFold(ss []string, s string) bool {
+	for _, s2 := range ss {
+		if strings.EqualFold(s2, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h header) rsv() RSV {
+	var rsv RSV
+	if h.rsv1 {
+		rsv |= RSV1
+	}
+	if h.rsv2 {
+		rsv |= RSV2
+	}
+	if h.rsv3 {
+		rsv |= RSV3
+	}
+	return rsv
+}
@@ -0,0 +1,375 @@
+// +build !js
+
+package websocket_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/internal/test/assert"
+	"nhooyr.io/websocket/internal/test/wstest"
+	"nhooyr.io/websocket/internal/test/xrand"
+)
+
+func TestExtension(t *testing.T) {
+	t.Parallel()
+
+	t.Run("transforms", func(t *testing.T) {
+		exts := []websocket.Extension{checksumExtension{name: "x-checksum"}, xorExtension{}}
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+			Extensions:      exts,
+		}, &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+			Extensions:      exts,
+		})
+		defer tt.cleanup()
+
+		exp := "permessage-deflate, x-checksum, x-xor; key=42"
+		assert.Equal(t, "Sec-WebSocket-Extensions", exp, c1.HandshakeInfo().ResponseHeader.Get("Sec-WebSocket-Extensions"))
+
+		tt.goEchoLoop(c2)
+		c1.SetReadLimit(131072)
+
+		for i := 0; i < 5; i++ {
+			err := wstest.Echo(tt.ctx, c1, 131072)
+			assert.Success(t, err)
+		}
+
+		// Stream a message over many frames.
+		w, err := c1.Writer(tt.ctx, websocket.MessageText)
+		assert.Success(t, err)
+		msg := strings.Repeat("hello", 1024)
+		for i := 0; i < len(msg); i += 1000 {
+			j := i + 1000
+			if j > len(msg) {
+				j = len(msg)
+			}
+			_, err = w.Write([]byte(msg[i:j]))
+			assert.Success(t, err)
+		}
+		err = w.Close()
+		assert.Success(t, err)
+
+		typ, p, err := c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "type", websocket.MessageText, typ)
+		assert.Equal(t, "msg", msg, string(p))
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("declined", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionDisabled,
+			Extensions:      []websocket.Extension{checksumExtension{name: "x-checksum"}},
+		}, nil)
+		defer tt.cleanup()
+
+		assert.Equal(t, "Sec-WebSocket-Extensions", "", c1.HandshakeInfo().ResponseHeader.Get("Sec-WebSocket-Extensions"))
+
+		tt.goEchoLoop(c2)
+
+		err := wstest.Echo(tt.ctx, c1, 1024)
+		assert.Success(t, err)
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("rsvConflict", func(t *testing.T) {
+		t.Parallel()
+
+		exts := []websocket.Extension{
+			checksumExtension{name: "x-checksum"},
+			checksumExtension{name: "x-checksum2"},
+		}
+		c1, c2 := wstest.Pipe(&websocket.DialOptions{
+			CompressionMode: websocket.CompressionDisabled,
+			Extensions:      exts,
+		}, &websocket.AcceptOptions{
+			Extensions: exts,
+		})
+		defer c1.Close(websocket.StatusInternalError, "")
+		defer c2.Close(websocket.StatusInternalError, "")
+
+		assert.Equal(t, "Sec-WebSocket-Extensions", "x-checksum", c1.HandshakeInfo().ResponseHeader.Get("Sec-WebSocket-Extensions"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		c2.CloseRead(ctx)
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("frameHandler", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		pongs := make(chan string, 1)
+		c1, c2 := wstest.Pipe(&websocket.DialOptions{
+			Extensions: []websocket.Extension{heartbeatExtension{pongs: pongs}},
+		}, &websocket.AcceptOptions{
+			Extensions: []websocket.Extension{heartbeatExtension{}},
+		})
+		defer c1.Close(websocket.StatusInternalError, "")
+		defer c2.Close(websocket.StatusInternalError, "")
+
+		c1.CloseRead(ctx)
+		c2.CloseRead(ctx)
+
+		err := c1.WriteExtensionFrame(ctx, heartbeatOpcode, []byte("ping"))
+		assert.Success(t, err)
+
+		select {
+		case p := <-pongs:
+			assert.Equal(t, "pong", "pong", p)
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+
+		err = c1.WriteExtensionFrame(ctx, 12, nil)
+		assert.Contains(t, err, "not handled by a negotiated extension")
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+}
+
+// checksumExtension appends a CRC-32 checksum to every data frame.
+type checksumExtension struct {
+	name string
+}
+
+func (e checksumExtension) Name() string {
+	return e.name
+}
+
+func (e checksumExtension) Offer() []string {
+	return nil
+}
+
+func (e checksumExtension) Accept(params []string) (websocket.ExtensionConn, []string, error) {
+	return &checksumConn{}, nil, nil
+}
+
+func (e checksumExtension) Negotiated(params []string) (websocket.ExtensionConn, error) {
+	return &checksumConn{}, nil
+}
+
+type checksumConn struct {
+	buf []byte
+}
+
+func (cc *checksumConn) RSV() websocket.RSV {
+	return websocket.RSV2
+}
+
+func (cc *checksumConn) Close() error {
+	return nil
+}
+
+func (cc *checksumConn) WriteFrame(p []byte, fin bool) ([]byte, websocket.RSV, error) {
+	cc.buf = append(cc.buf[:0], p...)
+	cc.buf = append(cc.buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(cc.buf[len(p):], crc32.ChecksumIEEE(p))
+	return cc.buf, websocket.RSV2, nil
+}
+
+func (cc *checksumConn) ReadFrame(p []byte, rsv websocket.RSV, fin bool) ([]byte, error) {
+	if rsv&websocket.RSV2 == 0 || len(p) < 4 {
+		return nil, errors.New("missing checksum")
+	}
+	i := len(p) - 4
+	if binary.BigEndian.Uint32(p[i:]) != crc32.ChecksumIEEE(p[:i]) {
+		return nil, errors.New("invalid checksum")
+	}
+	return p[:i], nil
+}
+
+// xorExtension xors every message with a key.
+type xorExtension struct{}
+
+func (e xorExtension) Name() string {
+	return "x-xor"
+}
+
+func (e xorExtension) Offer() []string {
+	return []string{"key=42"}
+}
+
+func (e xorExtension) Accept(params []string) (websocket.ExtensionConn, []string, error) {
+	xc, err := e.Negotiated(params)
+	if err != nil {
+		return nil, nil, err
+	}
+	return xc, params, nil
+}
+
+func (e xorExtension) Negotiated(params []string) (websocket.ExtensionConn, error) {
+	if len(params) != 1 || !strings.HasPrefix(params[0], "key=") {
+		return nil, fmt.Errorf("unexpected x-xor parameters: %q", params)
+	}
+	key, err := strconv.ParseUint(strings.TrimPrefix(params[0], "key="), 10, 8)
+	if err != nil {
+		return nil, err
+	}
+	return &xorConn{key: byte(key)}, nil
+}
+
+type xorConn struct {
+	key byte
+	w   xorWriter
+	r   xorReader
+}
+
+func (xc *xorConn) RSV() websocket.RSV {
+	return websocket.RSV3
+}
+
+func (xc *xorConn) Close() error {
+	return nil
+}
+
+func (xc *xorConn) WriteMessage(w io.Writer, typ websocket.MessageType, sizeHint int) (io.WriteCloser, websocket.RSV, error) {
+	if xrand.Bool() {
+		// Leave some messages as is.
+		return nil, 0, nil
+	}
+	xc.w = xorWriter{w: w, key: xc.key}
+	return &xc.w, websocket.RSV3, nil
+}
+
+func (xc *xorConn) ReadMessage(r io.Reader, typ websocket.MessageType, rsv websocket.RSV) (io.Reader, error) {
+	if rsv&websocket.RSV3 == 0 {
+		return r, nil
+	}
+	xc.r = xorReader{r: r, key: xc.key}
+	return &xc.r, nil
+}
+
+type xorWriter struct {
+	w   io.Writer
+	key byte
+	buf []byte
+}
+
+func (xw *xorWriter) Write(p []byte) (int, error) {
+	xw.buf = append(xw.buf[:0], p...)
+	for i := range xw.buf {
+		xw.buf[i] ^= xw.key
+	}
+	return xw.w.Write(xw.buf)
+}
+
+func (xw *xorWriter) Close() error {
+	return nil
+}
+
+type xorReader struct {
+	r   io.Reader
+	key byte
+}
+
+func (xr *xorReader) Read(p []byte) (int, error) {
+	n, err := xr.r.Read(p)
+	for i := range p[:n] {
+		p[i] ^= xr.key
+	}
+	return n, err
+}
+
+const heartbeatOpcode = 11
+
+// heartbeatExtension replies to heartbeat frames with a reserved opcode.
+type heartbeatExtension struct {
+	pongs chan<- string
+}
+
+func (e heartbeatExtension) Name() string {
+	return "x-heartbeat"
+}
+
+func (e heartbeatExtension) Offer() []string {
+	return nil
+}
+
+func (e heartbeatExtension) Accept(params []string) (websocket.ExtensionConn, []string, error) {
+	return e, nil, nil
+}
+
+func (e heartbeatExtension) Negotiated(params []string) (websocket.ExtensionConn, error) {
+	return e, nil
+}
+
+func (e heartbeatExtension) RSV() websocket.RSV {
+	return 0
+}
+
+func (e heartbeatExtension) Close() error {
+	return nil
+}
+
+func (e heartbeatExtension) Opcodes() []int {
+	return []int{heartbeatOpcode}
+}
+
+func (e heartbeatExtension) HandleFrame(ctx context.Context, c *websocket.Conn, opcode int, p []byte) error {
+	if bytes.Equal(p, []byte("ping")) {
+		return c.WriteExtensionFrame(ctx, heartbeatOpcode, []byte("pong"))
+	}
+	e.pongs <- string(p)
+	return nil
+}
+
+// rsvExtension reports the reserved bits of every message read.
+type rsvExtension struct {
+	rsvs chan<- websocket.RSV
+}
+
+func (e rsvExtension) Name() string {
+	return "x-rsv"
+}
+
+func (e rsvExtension) Offer() []string {
+	return nil
+}
+
+func (e rsvExtension) Accept(params []string) (websocket.ExtensionConn, []string, error) {
+	return e, nil, nil
+}
+
+func (e rsvExtension) Negotiated(params []string) (websocket.ExtensionConn, error) {
+	return e, nil
+}
+
+func (e rsvExtension) RSV() websocket.RSV {
+	return 0
+}
+
+func (e rsvExtension) Close() error {
+	return nil
+}
+
+func (e rsvExtension) WriteMessage(w io.Writer, typ websocket.MessageType, sizeHint int) (io.WriteCloser, websocket.RSV, error) {
+	return nil, 0, nil
+}
+
+func (e rsvExtension) ReadMessage(r io.Reader, typ websocket.MessageType, rsv websocket.RSV) (io.Reader, error) {
+	e.rsvs <- rsv
+	return r, nil
+}
@@ -0,0 +1,6 @@
+// Package h3 tests WebSockets over HTTP/2 and HTTP/3 against the
+// golang.org/x/net/http2 and quic-go clients and servers.
+//
+// It is a separate module so that importers of nhooyr.io/websocket
+// do not depend on them.
+package h3
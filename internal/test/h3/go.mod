@@ -0,0 +1,21 @@
+module nhooyr.io/websocket/internal/test/h3
+
+go 1.24
+
+require (
+	github.com/quic-go/quic-go v0.59.1
+	golang.org/x/net v0.43.0
+	nhooyr.io/websocket v0.0.0
+)
+
+require (
+	github.com/golang/protobuf v1.3.5 // indirect
+	github.com/google/go-cmp v0.6.0 // indirect
+	github.com/klauspost/compress v1.17.0 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+)
+
+replace nhooyr.io/websocket => ../../..
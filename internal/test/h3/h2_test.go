@@ -0,0 +1,182 @@
+// +build !js
+
+package h3_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/internal/test/assert"
+)
+
+func TestAcceptHTTP2(t *testing.T) {
+	if !enableHTTP2ExtendedConnect(t) {
+		return
+	}
+	t.Parallel()
+
+	s := httptest.NewUnstartedServer(echoOnceHandler(t))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	req, _ := http.NewRequestWithContext(ctx, "CONNECT", s.URL, pr)
+	req.Header.Set(":protocol", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", "echo")
+
+	resp, err := http2Client(s).Do(req)
+	assert.Success(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "status code", http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "proto", 2, resp.ProtoMajor)
+	assert.Equal(t, "subprotocol", "echo", resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	// The frames are written by hand as a client Conn can only be
+	// created by Dial. The mask keys are zero so the payloads are
+	// sent as is.
+	_, err = pw.Write([]byte("\x81\x85\x00\x00\x00\x00hello"))
+	assert.Success(t, err)
+	assertReadFrame(t, resp.Body, "\x81\x05hello")
+
+	assertReadFrame(t, resp.Body, "\x88\x02\x03\xe8")
+	_, err = pw.Write([]byte("\x88\x82\x00\x00\x00\x00\x03\xe8"))
+	assert.Success(t, err)
+}
+
+func TestDialHTTP2(t *testing.T) {
+	if !enableHTTP2ExtendedConnect(t) {
+		return
+	}
+	t.Parallel()
+
+	s, conns := newHTTP2EchoServer(t)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	opts := &websocket.DialOptions{
+		HTTPClient:   s.Client(),
+		HTTP2Client:  http2Client(s),
+		Subprotocols: []string{"echo"},
+	}
+
+	for i := 0; i < 3; i++ {
+		c, resp, err := websocket.Dial(ctx, s.URL, opts)
+		assert.Success(t, err)
+		assert.Equal(t, "status code", http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "proto", 2, resp.ProtoMajor)
+		assert.Equal(t, "subprotocol", "echo", c.Subprotocol())
+
+		assertEcho(ctx, t, c)
+	}
+
+	assert.Equal(t, "connections", int64(1), atomic.LoadInt64(conns))
+}
+
+func TestDialHTTP2Fallback(t *testing.T) {
+	if strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	s, _ := newHTTP2EchoServer(t)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	c, resp, err := websocket.Dial(ctx, s.URL, &websocket.DialOptions{
+		HTTPClient:   s.Client(),
+		HTTP2Client:  http2Client(s),
+		Subprotocols: []string{"echo"},
+	})
+	assert.Success(t, err)
+	assert.Equal(t, "status code", http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "subprotocol", "echo", c.Subprotocol())
+
+	assertEcho(ctx, t, c)
+}
+
+func assertReadFrame(t *testing.T, r io.Reader, exp string) {
+	t.Helper()
+
+	b := make([]byte, len(exp))
+	_, err := io.ReadFull(r, b)
+	assert.Success(t, err)
+	if !bytes.Equal([]byte(exp), b) {
+		t.Fatalf("expected frame %q but got %q", exp, b)
+	}
+}
+
+// newHTTP2EchoServer returns a TLS server with HTTP/2 enabled that runs
+// echoOnceHandler. It counts the connections made to it.
+func newHTTP2EchoServer(t *testing.T) (*httptest.Server, *int64) {
+	var conns int64
+	s := httptest.NewUnstartedServer(echoOnceHandler(t))
+	s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	return s, &conns
+}
+
+// http2Client returns a client for s that uses x/net's HTTP/2 transport
+// as it supports extended CONNECT.
+func http2Client(s *httptest.Server) *http.Client {
+	return &http.Client{
+		Transport: &http2.Transport{
+			TLSClientConfig: s.Client().Transport.(*http.Transport).TLSClientConfig,
+		},
+	}
+}
+
+// enableHTTP2ExtendedConnect reruns the calling test in a subprocess with
+// extended CONNECT enabled in net/http's HTTP/2 server as it can only be
+// enabled with GODEBUG=http2xconnect=1 at startup.
+// See https://github.com/golang/go/issues/71128
+//
+// It returns false in the parent process, which should return immediately.
+func enableHTTP2ExtendedConnect(t *testing.T) bool {
+	t.Helper()
+
+	godebug := os.Getenv("GODEBUG")
+	if strings.Contains(godebug, "http2xconnect=1") {
+		return true
+	}
+	if godebug != "" {
+		godebug += ","
+	}
+	godebug += "http2xconnect=1"
+
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), "GODEBUG="+godebug)
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v with http2xconnect=1 failed: %v:\n%s", t.Name(), err, b)
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+// +build !js
+
+package h3_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/internal/test/assert"
+)
+
+func TestDialHTTP3(t *testing.T) {
+	t.Parallel()
+
+	s := http3Server(t, echoOnceHandler(t))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	c, resp, err := websocket.Dial(ctx, "wss://"+s.Addr, &websocket.DialOptions{
+		HTTPClient: &http.Client{
+			Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				return nil, errors.New("unexpected HTTP/1.1 request")
+			}),
+		},
+		HTTP3Client:  http3Client(t, s),
+		Subprotocols: []string{"echo"},
+	})
+	assert.Success(t, err)
+	assert.Equal(t, "status code", http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "proto", 3, resp.ProtoMajor)
+	assert.Equal(t, "subprotocol", "echo", c.Subprotocol())
+
+	assertEcho(ctx, t, c)
+}
+
+// http3Server serves h over HTTP/3 on a loopback UDP socket. Addr is set
+// to the address it listens on.
+func http3Server(t *testing.T, h http.Handler) *http3.Server {
+	t.Helper()
+
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	tlsConfig := ts.TLS
+	ts.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Success(t, err)
+
+	s := &http3.Server{
+		Handler:   h,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+	}
+	s.Addr = pc.LocalAddr().String()
+	go s.Serve(pc)
+	t.Cleanup(func() {
+		s.Close()
+		pc.Close()
+	})
+	return s
+}
+
+func http3Client(t *testing.T, s *http3.Server) *http.Client {
+	t.Helper()
+
+	certPool := x509.NewCertPool()
+	for _, cert := range s.TLSConfig.Certificates {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		assert.Success(t, err)
+		certPool.AddCert(leaf)
+	}
+	return &http.Client{
+		Transport: &http3.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: certPool,
+			},
+		},
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// echoOnceHandler echoes a single message on every WebSocket
+// and then closes it.
+func echoOnceHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols: []string{"echo"},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close(websocket.StatusInternalError, "")
+
+		typ, p, err := c.Read(r.Context())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		err = c.Write(r.Context(), typ, p)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		c.Close(websocket.StatusNormalClosure, "")
+	})
+}
+
+func assertEcho(ctx context.Context, t *testing.T, c *websocket.Conn) {
+	t.Helper()
+	defer c.Close(websocket.StatusInternalError, "")
+
+	msg := []byte(strings.Repeat("hello", 128))
+	err := c.Write(ctx, websocket.MessageText, msg)
+	assert.Success(t, err)
+
+	typ, p, err := c.Read(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "type", websocket.MessageText, typ)
+	assert.Equal(t, "msg", msg, p)
+
+	_, _, err = c.Read(ctx)
+	assert.Equal(t, "close status", websocket.StatusNormalClosure, websocket.CloseStatus(err))
+}
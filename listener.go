@@ -0,0 +1,176 @@
+// +build !js
+
+package websocket
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// ListenerOptions represents Listener's options.
+type ListenerOptions struct {
+	// AcceptOptions is passed to Accept for every handshake.
+	AcceptOptions *AcceptOptions
+
+	// MessageType is the message type passed to NetConn.
+	// Defaults to MessageBinary.
+	MessageType MessageType
+
+	// Backlog is the maximum number of upgraded connections waiting to be
+	// returned from Listener.Accept. Once reached, handshakes are rejected with
+	// 503 Service Unavailable until the application accepts more connections.
+	// Defaults to 128.
+	Backlog int
+
+	// Addr is returned from Listener.Addr.
+	// Defaults to a mock net.Addr like the one returned by NetConn.
+	Addr net.Addr
+}
+
+// Listener is an http.Handler that accepts WebSocket connections and
+// a net.Listener that returns them wrapped with NetConn.
+//
+// It allows serving protocols built on net.Listener such as an
+// http.Server or a gRPC server behind a WebSocket endpoint.
+//
+// ServeHTTP does not return until the net.Conn is closed.
+type Listener struct {
+	opts ListenerOptions
+
+	conns   chan net.Conn
+	backlog chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var _ net.Listener = &Listener{}
+var _ http.Handler = &Listener{}
+
+// NewListener returns a new Listener.
+func NewListener(opts *ListenerOptions) *Listener {
+	if opts == nil {
+		opts = &ListenerOptions{}
+	}
+	opts = &*opts
+	if opts.MessageType == 0 {
+		opts.MessageType = MessageBinary
+	}
+	if opts.Backlog <= 0 {
+		opts.Backlog = 128
+	}
+	if opts.Addr == nil {
+		opts.Addr = websocketAddr{}
+	}
+
+	return &Listener{
+		opts:    *opts,
+		conns:   make(chan net.Conn),
+		backlog: make(chan struct{}, opts.Backlog),
+		closed:  make(chan struct{}),
+	}
+}
+
+// ServeHTTP accepts the WebSocket handshake in r and queues the
+// connection to be returned from Accept.
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-l.closed:
+		http.Error(w, "listener closed", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	// Reserve a place in the backlog before upgrading so that
+	// excess handshakes can still be rejected with a status code.
+	select {
+	case l.backlog <- struct{}{}:
+	default:
+		http.Error(w, "too many pending connections", http.StatusServiceUnavailable)
+		return
+	}
+	queued := true
+	defer func() {
+		if queued {
+			<-l.backlog
+		}
+	}()
+
+	c, err := Accept(w, r, l.opts.AcceptOptions)
+	if err != nil {
+		return
+	}
+
+	ctx := r.Context()
+	nc := &listenerConn{
+		Conn:   NetConn(ctx, c, l.opts.MessageType),
+		closed: make(chan struct{}),
+	}
+
+	select {
+	case l.conns <- nc:
+		<-l.backlog
+		queued = false
+	case <-l.closed:
+		c.Close(StatusGoingAway, "listener closed")
+		return
+	case <-ctx.Done():
+		c.Close(StatusGoingAway, "")
+		return
+	}
+
+	select {
+	case <-nc.closed:
+	case <-ctx.Done():
+		nc.Close()
+	}
+}
+
+// Accept waits for and returns the next WebSocket connection.
+// After Close, it returns an error wrapping net.ErrClosed.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, &net.OpError{
+			Op:   "accept",
+			Net:  l.opts.Addr.Network(),
+			Addr: l.opts.Addr,
+			Err:  net.ErrClosed,
+		}
+	}
+}
+
+// Close stops accepting connections. Handshakes waiting in the backlog
+// are closed with StatusGoingAway and new handshakes are rejected with
+// 503 Service Unavailable. Connections already returned from Accept
+// are not affected.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+// Addr returns the Addr option.
+func (l *Listener) Addr() net.Addr {
+	return l.opts.Addr
+}
+
+// listenerConn signals when it is closed so that
+// Listener.ServeHTTP knows when to return.
+type listenerConn struct {
+	net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *listenerConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return err
+}
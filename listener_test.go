@@ -0,0 +1,166 @@
+// +build !js
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket/internal/test/assert"
+)
+
+func TestListener(t *testing.T) {
+	t.Parallel()
+
+	t.Run("echo", func(t *testing.T) {
+		t.Parallel()
+
+		l := NewListener(nil)
+		defer l.Close()
+		s := httptest.NewServer(l)
+		defer s.Close()
+
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+			io.Copy(c, c)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		c, _, err := Dial(ctx, s.URL, nil)
+		assert.Success(t, err)
+		defer c.Close(StatusInternalError, "")
+
+		err = c.Write(ctx, MessageBinary, []byte("hello"))
+		assert.Success(t, err)
+
+		typ, p, err := c.Read(ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "type", MessageBinary, typ)
+		assert.Equal(t, "msg", []byte("hello"), p)
+
+		c.Close(StatusNormalClosure, "")
+	})
+
+	t.Run("httpServer", func(t *testing.T) {
+		t.Parallel()
+
+		l := NewListener(nil)
+		s := httptest.NewServer(l)
+		defer s.Close()
+
+		hs := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("hello " + r.URL.Path))
+			}),
+		}
+		go hs.Serve(l)
+		defer hs.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		hc := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					c, _, err := Dial(ctx, s.URL, nil)
+					if err != nil {
+						return nil, err
+					}
+					return NetConn(context.Background(), c, MessageBinary), nil
+				},
+			},
+		}
+		defer hc.CloseIdleConnections()
+
+		req, _ := http.NewRequestWithContext(ctx, "GET", "http://example.com/tunnel", nil)
+		resp, err := hc.Do(req)
+		assert.Success(t, err)
+		defer resp.Body.Close()
+
+		b, err := ioutil.ReadAll(resp.Body)
+		assert.Success(t, err)
+		assert.Equal(t, "body", "hello /tunnel", string(b))
+	})
+
+	t.Run("backlog", func(t *testing.T) {
+		t.Parallel()
+
+		l := NewListener(&ListenerOptions{
+			Backlog: 1,
+		})
+		defer l.Close()
+		s := httptest.NewServer(l)
+		defer s.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		c1, _, err := Dial(ctx, s.URL, nil)
+		assert.Success(t, err)
+		defer c1.Close(StatusInternalError, "")
+
+		_, resp, err := Dial(ctx, s.URL, nil)
+		assert.Error(t, err)
+		assert.Equal(t, "status code", http.StatusServiceUnavailable, resp.StatusCode)
+
+		// Accepting makes room for another connection.
+		nc1, err := l.Accept()
+		assert.Success(t, err)
+		go io.Copy(ioutil.Discard, nc1)
+
+		c2, _, err := Dial(ctx, s.URL, nil)
+		assert.Success(t, err)
+		defer c2.Close(StatusInternalError, "")
+
+		nc2, err := l.Accept()
+		assert.Success(t, err)
+		go io.Copy(ioutil.Discard, nc2)
+
+		c1.Close(StatusNormalClosure, "")
+		c2.Close(StatusNormalClosure, "")
+	})
+
+	t.Run("close", func(t *testing.T) {
+		t.Parallel()
+
+		l := NewListener(nil)
+		s := httptest.NewServer(l)
+		defer s.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		c, _, err := Dial(ctx, s.URL, nil)
+		assert.Success(t, err)
+		defer c.Close(StatusInternalError, "")
+
+		err = l.Close()
+		assert.Success(t, err)
+
+		_, err = l.Accept()
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("expected net.ErrClosed: %v", err)
+		}
+
+		_, _, err = c.Read(ctx)
+		assert.Equal(t, "close status", StatusGoingAway, CloseStatus(err))
+
+		_, resp, err := Dial(ctx, s.URL, nil)
+		assert.Error(t, err)
+		assert.Equal(t, "status code", http.StatusServiceUnavailable, resp.StatusCode)
+	})
+}
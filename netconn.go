@@ -4,8 +4,8 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"math"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
@@ -28,32 +28,33 @@ import (
 //
 // Close will close the *websocket.Conn with StatusNormalClosure.
 //
-// When a deadline is hit, the connection will be closed. This is
-// different from most net.Conn implementations where only the
-// reading/writing goroutines are interrupted but the connection is kept alive.
+// When a deadline is hit, reads and writes return an error that satisfies
+// net.Error with Timeout returning true and wraps os.ErrDeadlineExceeded.
+// An expired read deadline leaves the connection usable once the deadline
+// is extended or cleared. As a message cannot be partially written, a write
+// deadline hit in the middle of a write closes the connection.
 //
-// The Addr methods will return a mock net.Addr that returns "websocket" for Network
+// The Addr methods return the addresses of the underlying connection if known.
+// Otherwise they return a mock net.Addr that returns "websocket" for Network
 // and "websocket/unknown-addr" for String.
 //
 // A received StatusNormalClosure or StatusGoingAway close frame will be translated to
 // io.EOF when reading.
 func NetConn(ctx context.Context, c *Conn, msgType MessageType) net.Conn {
 	nc := &netConn{
-		c:       c,
-		msgType: msgType,
+		c:             c,
+		msgType:       msgType,
+		ctx:           ctx,
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
 	}
 
-	var cancel context.CancelFunc
-	nc.writeContext, cancel = context.WithCancel(ctx)
-	nc.writeTimer = time.AfterFunc(math.MaxInt64, cancel)
-	if !nc.writeTimer.Stop() {
-		<-nc.writeTimer.C
+	nc.localAddr, nc.remoteAddr = c.netAddrs()
+	if nc.localAddr == nil {
+		nc.localAddr = websocketAddr{}
 	}
-
-	nc.readContext, cancel = context.WithCancel(ctx)
-	nc.readTimer = time.AfterFunc(math.MaxInt64, cancel)
-	if !nc.readTimer.Stop() {
-		<-nc.readTimer.C
+	if nc.remoteAddr == nil {
+		nc.remoteAddr = websocketAddr{}
 	}
 
 	return nc
@@ -62,18 +63,33 @@ func NetConn(ctx context.Context, c *Conn, msgType MessageType) net.Conn {
 type netConn struct {
 	c       *Conn
 	msgType MessageType
+	ctx     context.Context
 
-	writeTimer   *time.Timer
-	writeContext context.Context
+	localAddr  net.Addr
+	remoteAddr net.Addr
 
-	readTimer   *time.Timer
-	readContext context.Context
+	writeDeadline *deadline
+	readDeadline  *deadline
 
 	readMu sync.Mutex
+	// readResult receives the result of the pending background read
+	// if readPending is set.
+	readPending bool
+	readResult  chan readResult
+	readBuf     []byte
+	// unread holds data from a background read not yet returned.
+	unread []byte
+
+	// Only accessed by the background read goroutine.
 	eofed  bool
 	reader io.Reader
 }
 
+type readResult struct {
+	n   int
+	err error
+}
+
 var _ net.Conn = &netConn{}
 
 func (c *netConn) Close() error {
@@ -81,23 +97,85 @@ func (c *netConn) Close() error {
 }
 
 func (c *netConn) Write(p []byte) (int, error) {
-	err := c.c.Write(c.writeContext, c.msgType, p)
+	expired := c.writeDeadline.wait()
+	select {
+	case <-expired:
+		return 0, c.opError("write", os.ErrDeadlineExceeded)
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-expired:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := c.c.Write(ctx, c.msgType, p)
 	if err != nil {
+		if isClosedChan(expired) && c.ctx.Err() == nil {
+			return 0, c.opError("write", os.ErrDeadlineExceeded)
+		}
 		return 0, err
 	}
 	return len(p), nil
 }
 
+// Read reads in a background goroutine so that an expired read deadline
+// only interrupts the caller and not the read from the *websocket.Conn.
 func (c *netConn) Read(p []byte) (int, error) {
 	c.readMu.Lock()
 	defer c.readMu.Unlock()
 
+	if len(c.unread) > 0 {
+		n := copy(p, c.unread)
+		c.unread = c.unread[n:]
+		return n, nil
+	}
+
+	expired := c.readDeadline.wait()
+	select {
+	case <-expired:
+		return 0, c.opError("read", os.ErrDeadlineExceeded)
+	default:
+	}
+
+	if !c.readPending {
+		if cap(c.readBuf) < len(p) {
+			c.readBuf = make([]byte, len(p))
+		}
+		if c.readResult == nil {
+			c.readResult = make(chan readResult, 1)
+		}
+		buf := c.readBuf[:len(p)]
+		c.readPending = true
+		go func() {
+			n, err := c.read(buf)
+			c.readResult <- readResult{n, err}
+		}()
+	}
+
+	select {
+	case <-expired:
+		return 0, c.opError("read", os.ErrDeadlineExceeded)
+	case r := <-c.readResult:
+		c.readPending = false
+		n := copy(p, c.readBuf[:r.n])
+		c.unread = c.readBuf[n:r.n]
+		return n, r.err
+	}
+}
+
+func (c *netConn) read(p []byte) (int, error) {
 	if c.eofed {
 		return 0, io.EOF
 	}
 
 	if c.reader == nil {
-		typ, r, err := c.c.Reader(c.readContext)
+		typ, r, err := c.c.Reader(c.ctx)
 		if err != nil {
 			switch CloseStatus(err) {
 			case StatusNormalClosure, StatusGoingAway:
@@ -122,6 +200,16 @@ func (c *netConn) Read(p []byte) (int, error) {
 	return n, err
 }
 
+func (c *netConn) opError(op string, err error) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    c.localAddr.Network(),
+		Source: c.localAddr,
+		Addr:   c.remoteAddr,
+		Err:    err,
+	}
+}
+
 type websocketAddr struct {
 }
 
@@ -134,11 +222,11 @@ func (a websocketAddr) String() string {
 }
 
 func (c *netConn) RemoteAddr() net.Addr {
-	return websocketAddr{}
+	return c.remoteAddr
 }
 
 func (c *netConn) LocalAddr() net.Addr {
-	return websocketAddr{}
+	return c.localAddr
 }
 
 func (c *netConn) SetDeadline(t time.Time) error {
@@ -148,19 +236,81 @@ func (c *netConn) SetDeadline(t time.Time) error {
 }
 
 func (c *netConn) SetWriteDeadline(t time.Time) error {
-	if t.IsZero() {
-		c.writeTimer.Stop()
-	} else {
-		c.writeTimer.Reset(t.Sub(time.Now()))
-	}
+	c.writeDeadline.set(t)
 	return nil
 }
 
 func (c *netConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// deadline is an abstraction for handling timeouts.
+// It is the same as the one in net.Pipe.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // Must be non-nil
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set sets the point in time when the deadline will time out.
+// A timeout event is signaled by closing the channel returned by waiter.
+// Once a timeout has occurred, the deadline can be refreshed by specifying a
+// t value in the future.
+//
+// A zero value for t prevents timeout.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // Wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	// Time is zero, then there is no deadline.
+	closed := isClosedChan(d.cancel)
 	if t.IsZero() {
-		c.readTimer.Stop()
-	} else {
-		c.readTimer.Reset(t.Sub(time.Now()))
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	// Time in the future, setup a timer to cancel in the future.
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	// Time in the past, so close immediately.
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline is exceeded.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
 	}
-	return nil
 }
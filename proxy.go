@@ -0,0 +1,297 @@
+// +build !js
+
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dialProxy connects to addr through the proxy at proxyURL.
+// The connection to the proxy itself is made with netDial.
+func dialProxy(ctx context.Context, netDial dialFunc, tlsConfig *tls.Config, proxyURL *url.URL, network, addr string) (_ net.Conn, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("failed to dial %v through proxy %v://%v: %w", addr, proxyURL.Scheme, proxyURL.Host, err)
+		}
+	}()
+
+	proxyAddr := canonicalProxyAddr(proxyURL)
+	c, err := netDial(ctx, network, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := handshakeDeadline(ctx, c)
+	c, err = proxyHandshake(ctx, c, tlsConfig, proxyURL, addr)
+	if err2 := stop(); err2 != nil {
+		err = err2
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func proxyHandshake(ctx context.Context, c net.Conn, tlsConfig *tls.Config, proxyURL *url.URL, addr string) (net.Conn, error) {
+	switch proxyURL.Scheme {
+	case "https":
+		cfg := &tls.Config{}
+		if tlsConfig != nil {
+			cfg = tlsConfig.Clone()
+		}
+		cfg.ServerName = proxyURL.Hostname()
+		// Only HTTP/1.1 can CONNECT to the target over the connection.
+		cfg.NextProtos = []string{"http/1.1"}
+		tc := tls.Client(c, cfg)
+		err := tc.HandshakeContext(ctx)
+		if err != nil {
+			return c, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		return httpConnect(ctx, tc, proxyURL, addr)
+	case "http":
+		return httpConnect(ctx, c, proxyURL, addr)
+	case "socks5":
+		// socks5 resolves the host on the client and socks5h on the proxy.
+		addr, err := resolveAddr(ctx, addr)
+		if err != nil {
+			return c, err
+		}
+		return c, socks5Connect(c, proxyURL, addr)
+	case "socks5h":
+		return c, socks5Connect(c, proxyURL, addr)
+	default:
+		return c, fmt.Errorf("unsupported proxy scheme: %q", proxyURL.Scheme)
+	}
+}
+
+func canonicalProxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// resolveAddr resolves the host in addr to its first IPv4 address
+// or its first address if it has none.
+func resolveAddr(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %q: %w", host, err)
+	}
+	ip := ips[0]
+	for _, ip4 := range ips {
+		if ip4.To4() != nil {
+			ip = ip4
+			break
+		}
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// httpConnect opens a tunnel to addr with an HTTP CONNECT request.
+// See https://tools.ietf.org/html/rfc7231#section-4.3.6
+func httpConnect(ctx context.Context, c net.Conn, proxyURL *url.URL, addr string) (net.Conn, error) {
+	req, _ := http.NewRequestWithContext(ctx, "CONNECT", "", nil)
+	req.URL = &url.URL{Opaque: addr}
+	req.Host = addr
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth := proxyURL.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+
+	err := req.Write(c)
+	if err != nil {
+		return c, fmt.Errorf("failed to write CONNECT request: %w", err)
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return c, fmt.Errorf("failed to read CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return c, fmt.Errorf("unexpected CONNECT response status: %v", resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: c, br: br}, nil
+	}
+	return c, nil
+}
+
+// bufferedConn is a net.Conn with data already read into br.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+const (
+	socks5Version = 5
+
+	socks5AuthNone     = 0
+	socks5AuthPassword = 2
+	socks5AuthNoAccept = 0xff
+
+	socks5CmdConnect = 1
+
+	socks5AddrIPv4   = 1
+	socks5AddrDomain = 3
+	socks5AddrIPv6   = 4
+)
+
+// socks5Connect opens a tunnel to addr with a SOCKS5 CONNECT request.
+// See https://tools.ietf.org/html/rfc1928 and https://tools.ietf.org/html/rfc1929
+func socks5Connect(c net.Conn, proxyURL *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port in address %q: %w", addr, err)
+	}
+
+	method := byte(socks5AuthNone)
+	if proxyURL.User != nil {
+		method = socks5AuthPassword
+	}
+	_, err = c.Write([]byte{socks5Version, 1, method})
+	if err != nil {
+		return fmt.Errorf("failed to write SOCKS5 greeting: %w", err)
+	}
+
+	b := make([]byte, 2)
+	_, err = io.ReadFull(c, b)
+	if err != nil {
+		return fmt.Errorf("failed to read SOCKS5 greeting: %w", err)
+	}
+	if b[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version: %v", b[0])
+	}
+	if b[1] == socks5AuthNoAccept || b[1] != method {
+		return errors.New("SOCKS5 proxy did not accept any authentication method")
+	}
+
+	if method == socks5AuthPassword {
+		err = socks5Authenticate(c, proxyURL.User)
+		if err != nil {
+			return err
+		}
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host too long for SOCKS5: %q", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	_, err = c.Write(req)
+	if err != nil {
+		return fmt.Errorf("failed to write SOCKS5 CONNECT request: %w", err)
+	}
+
+	b = make([]byte, 4)
+	_, err = io.ReadFull(c, b)
+	if err != nil {
+		return fmt.Errorf("failed to read SOCKS5 CONNECT reply: %w", err)
+	}
+	if b[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version: %v", b[0])
+	}
+	if b[1] != 0 {
+		return fmt.Errorf("SOCKS5 CONNECT failed with reply code %v", b[1])
+	}
+
+	var n int
+	switch b[3] {
+	case socks5AddrIPv4:
+		n = net.IPv4len
+	case socks5AddrIPv6:
+		n = net.IPv6len
+	case socks5AddrDomain:
+		_, err = io.ReadFull(c, b[:1])
+		if err != nil {
+			return fmt.Errorf("failed to read SOCKS5 CONNECT reply: %w", err)
+		}
+		n = int(b[0])
+	default:
+		return fmt.Errorf("unexpected SOCKS5 address type: %v", b[3])
+	}
+	// Discard the bound address and port.
+	_, err = io.ReadFull(c, make([]byte, n+2))
+	if err != nil {
+		return fmt.Errorf("failed to read SOCKS5 CONNECT reply: %w", err)
+	}
+	return nil
+}
+
+func socks5Authenticate(c net.Conn, user *url.Userinfo) error {
+	username := user.Username()
+	password, _ := user.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("SOCKS5 username or password too long")
+	}
+
+	req := []byte{1, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	_, err := c.Write(req)
+	if err != nil {
+		return fmt.Errorf("failed to write SOCKS5 authentication: %w", err)
+	}
+
+	b := make([]byte, 2)
+	_, err = io.ReadFull(c, b)
+	if err != nil {
+		return fmt.Errorf("failed to read SOCKS5 authentication reply: %w", err)
+	}
+	if b[1] != 0 {
+		return errors.New("SOCKS5 authentication failed")
+	}
+	return nil
+}
@@ -0,0 +1,416 @@
+// +build !js
+
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket/internal/test/assert"
+)
+
+func TestDialProxy(t *testing.T) {
+	t.Parallel()
+
+	t.Run("httpConnect", func(t *testing.T) {
+		t.Parallel()
+
+		s := httptest.NewServer(echoOnceHandler(t))
+		defer s.Close()
+
+		p := newTestProxy(t, serveHTTPConnect(t, "user:pass"))
+		defer p.Close()
+
+		testDialProxy(t, s.URL, &DialOptions{
+			Proxy: http.ProxyURL(&url.URL{
+				Scheme: "http",
+				User:   url.UserPassword("user", "pass"),
+				Host:   p.Addr().String(),
+			}),
+		})
+		assert.Equal(t, "tunnels", int64(1), atomic.LoadInt64(&p.tunnels))
+	})
+
+	t.Run("httpConnectTLS", func(t *testing.T) {
+		t.Parallel()
+
+		s := httptest.NewTLSServer(echoOnceHandler(t))
+		defer s.Close()
+
+		p := newTestProxy(t, serveHTTPConnect(t, ""))
+		defer p.Close()
+
+		// The proxy must be used even though the caller's Transport has its own.
+		hc := s.Client()
+		hc.Transport.(*http.Transport).Proxy = func(*http.Request) (*url.URL, error) {
+			return nil, errors.New("transport proxy should not be used")
+		}
+
+		testDialProxy(t, s.URL, &DialOptions{
+			HTTPClient: hc,
+			Proxy: http.ProxyURL(&url.URL{
+				Scheme: "http",
+				Host:   p.Addr().String(),
+			}),
+		})
+		assert.Equal(t, "tunnels", int64(1), atomic.LoadInt64(&p.tunnels))
+	})
+
+	t.Run("httpsConnect", func(t *testing.T) {
+		t.Parallel()
+
+		s := httptest.NewTLSServer(echoOnceHandler(t))
+		defer s.Close()
+
+		p := newTLSTestProxy(t, &tls.Config{
+			Certificates: s.TLS.Certificates,
+			NextProtos:   []string{"h2", "http/1.1"},
+		}, serveHTTPConnect(t, ""))
+		defer p.Close()
+
+		// The proxy is dialed with the caller's TLS config but must not
+		// negotiate HTTP/2 as CONNECT is sent with HTTP/1.1.
+		hc := s.Client()
+		hc.Transport.(*http.Transport).TLSClientConfig.NextProtos = []string{"h2", "http/1.1"}
+
+		testDialProxy(t, s.URL, &DialOptions{
+			HTTPClient: hc,
+			Proxy: http.ProxyURL(&url.URL{
+				Scheme: "https",
+				Host:   p.Addr().String(),
+			}),
+		})
+		assert.Equal(t, "tunnels", int64(1), atomic.LoadInt64(&p.tunnels))
+		assert.Equal(t, "proto", "http/1.1", p.proto.Load())
+	})
+
+	t.Run("httpsConnectCanceled", func(t *testing.T) {
+		t.Parallel()
+
+		// The proxy never completes the TLS handshake.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Success(t, err)
+		defer l.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			cancel()
+			io.Copy(ioutil.Discard, c)
+		}()
+
+		_, _, err = Dial(ctx, "wss://example.com", &DialOptions{
+			Proxy: http.ProxyURL(&url.URL{
+				Scheme: "https",
+				Host:   l.Addr().String(),
+			}),
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled: %v", err)
+		}
+	})
+
+	t.Run("httpConnectUnauthorized", func(t *testing.T) {
+		t.Parallel()
+
+		p := newTestProxy(t, serveHTTPConnect(t, "user:pass"))
+		defer p.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		_, _, err := Dial(ctx, "ws://example.com", &DialOptions{
+			Proxy: http.ProxyURL(&url.URL{
+				Scheme: "http",
+				Host:   p.Addr().String(),
+			}),
+		})
+		assert.Contains(t, err, "unexpected CONNECT response status: 407")
+	})
+
+	t.Run("socks5", func(t *testing.T) {
+		t.Parallel()
+
+		s := httptest.NewServer(echoOnceHandler(t))
+		defer s.Close()
+		_, port, err := net.SplitHostPort(s.Listener.Addr().String())
+		assert.Success(t, err)
+
+		p := newTestProxy(t, serveSOCKS5(t, "user", "pass"))
+		defer p.Close()
+
+		// socks5 resolves localhost before it reaches the proxy.
+		testDialProxy(t, "ws://localhost:"+port, &DialOptions{
+			Proxy: http.ProxyURL(&url.URL{
+				Scheme: "socks5",
+				User:   url.UserPassword("user", "pass"),
+				Host:   p.Addr().String(),
+			}),
+		})
+		assert.Equal(t, "tunnels", int64(1), atomic.LoadInt64(&p.tunnels))
+		assert.Equal(t, "addr", s.Listener.Addr().String(), p.addr.Load())
+	})
+
+	t.Run("socks5h", func(t *testing.T) {
+		t.Parallel()
+
+		s := httptest.NewServer(echoOnceHandler(t))
+		defer s.Close()
+		_, port, err := net.SplitHostPort(s.Listener.Addr().String())
+		assert.Success(t, err)
+
+		p := newTestProxy(t, serveSOCKS5(t, "", ""))
+		defer p.Close()
+
+		// socks5h leaves resolving localhost to the proxy.
+		testDialProxy(t, "ws://localhost:"+port, &DialOptions{
+			Proxy: http.ProxyURL(&url.URL{
+				Scheme: "socks5h",
+				Host:   p.Addr().String(),
+			}),
+		})
+		assert.Equal(t, "tunnels", int64(1), atomic.LoadInt64(&p.tunnels))
+		assert.Equal(t, "addr", "localhost:"+port, p.addr.Load())
+	})
+
+	t.Run("customTransport", func(t *testing.T) {
+		t.Parallel()
+
+		s := httptest.NewServer(echoOnceHandler(t))
+		defer s.Close()
+
+		p := newTestProxy(t, serveHTTPConnect(t, ""))
+		defer p.Close()
+
+		// The proxy does not require an *http.Transport.
+		testDialProxy(t, s.URL, &DialOptions{
+			HTTPClient: mockHTTPClient(func(r *http.Request) (*http.Response, error) {
+				return nil, errors.New("transport should not be used")
+			}),
+			Proxy: http.ProxyURL(&url.URL{
+				Scheme: "http",
+				Host:   p.Addr().String(),
+			}),
+		})
+		assert.Equal(t, "tunnels", int64(1), atomic.LoadInt64(&p.tunnels))
+	})
+
+	t.Run("noProxy", func(t *testing.T) {
+		t.Parallel()
+
+		s := httptest.NewServer(echoOnceHandler(t))
+		defer s.Close()
+
+		testDialProxy(t, s.URL, &DialOptions{
+			Proxy: func(*http.Request) (*url.URL, error) {
+				return nil, nil
+			},
+		})
+	})
+
+	t.Run("badScheme", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		_, _, err := Dial(ctx, "ws://example.com", &DialOptions{
+			Proxy: http.ProxyURL(&url.URL{
+				Scheme: "ftp",
+				Host:   "127.0.0.1:21",
+			}),
+		})
+		assert.Contains(t, err, `unsupported proxy scheme: "ftp"`)
+	})
+}
+
+func testDialProxy(t *testing.T, u string, opts *DialOptions) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	opts.Subprotocols = []string{"echo"}
+	c, _, err := Dial(ctx, u, opts)
+	assert.Success(t, err)
+
+	assertEcho(ctx, t, c)
+}
+
+// testProxy is a stand-in proxy that hands each connection to serve.
+type testProxy struct {
+	net.Listener
+	tunnels int64
+	addr    atomic.Value // last tunneled address
+	proto   atomic.Value // last protocol negotiated with ALPN
+}
+
+func newTestProxy(t *testing.T, serve func(c net.Conn, br *bufio.Reader) (string, bool)) *testProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Success(t, err)
+
+	return serveTestProxy(t, l, serve)
+}
+
+// newTLSTestProxy is like newTestProxy but clients connect to it over TLS.
+func newTLSTestProxy(t *testing.T, cfg *tls.Config, serve func(c net.Conn, br *bufio.Reader) (string, bool)) *testProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Success(t, err)
+
+	return serveTestProxy(t, tls.NewListener(l, cfg), serve)
+}
+
+func serveTestProxy(t *testing.T, l net.Listener, serve func(c net.Conn, br *bufio.Reader) (string, bool)) *testProxy {
+	p := &testProxy{Listener: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+
+				br := bufio.NewReader(c)
+				addr, ok := serve(c, br)
+				if !ok {
+					return
+				}
+				if tc, ok := c.(*tls.Conn); ok {
+					p.proto.Store(tc.ConnectionState().NegotiatedProtocol)
+				}
+
+				tc, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer tc.Close()
+				atomic.AddInt64(&p.tunnels, 1)
+				p.addr.Store(addr)
+
+				go io.Copy(tc, br)
+				io.Copy(c, tc)
+			}()
+		}
+	}()
+	return p
+}
+
+func serveHTTPConnect(t *testing.T, userinfo string) func(c net.Conn, br *bufio.Reader) (string, bool) {
+	return func(c net.Conn, br *bufio.Reader) (string, bool) {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			t.Error(err)
+			return "", false
+		}
+		if req.Method != "CONNECT" {
+			t.Errorf("unexpected method: %q", req.Method)
+			return "", false
+		}
+		if userinfo != "" && req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(userinfo)) {
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+			return "", false
+		}
+		_, err = io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		if err != nil {
+			t.Error(err)
+			return "", false
+		}
+		return req.Host, true
+	}
+}
+
+func serveSOCKS5(t *testing.T, username, password string) func(c net.Conn, br *bufio.Reader) (string, bool) {
+	return func(c net.Conn, br *bufio.Reader) (string, bool) {
+		b := make([]byte, 2)
+		_, err := io.ReadFull(br, b)
+		if err != nil {
+			t.Error(err)
+			return "", false
+		}
+		methods := make([]byte, b[1])
+		_, err = io.ReadFull(br, methods)
+		if err != nil {
+			t.Error(err)
+			return "", false
+		}
+
+		method := byte(socks5AuthNone)
+		if username != "" {
+			method = socks5AuthPassword
+		}
+		c.Write([]byte{socks5Version, method})
+
+		if method == socks5AuthPassword {
+			_, err = io.ReadFull(br, b)
+			if err != nil {
+				t.Error(err)
+				return "", false
+			}
+			user := make([]byte, b[1])
+			io.ReadFull(br, user)
+			n, _ := br.ReadByte()
+			pass := make([]byte, n)
+			_, err = io.ReadFull(br, pass)
+			if err != nil {
+				t.Error(err)
+				return "", false
+			}
+			if string(user) != username || string(pass) != password {
+				c.Write([]byte{1, 1})
+				return "", false
+			}
+			c.Write([]byte{1, 0})
+		}
+
+		b = make([]byte, 4)
+		_, err = io.ReadFull(br, b)
+		if err != nil {
+			t.Error(err)
+			return "", false
+		}
+		var host string
+		switch b[3] {
+		case socks5AddrIPv4:
+			ip := make([]byte, net.IPv4len)
+			io.ReadFull(br, ip)
+			host = net.IP(ip).String()
+		case socks5AddrDomain:
+			n, _ := br.ReadByte()
+			name := make([]byte, n)
+			io.ReadFull(br, name)
+			host = string(name)
+		default:
+			t.Errorf("unexpected address type: %v", b[3])
+			return "", false
+		}
+		port := make([]byte, 2)
+		_, err = io.ReadFull(br, port)
+		if err != nil {
+			t.Error(err)
+			return "", false
+		}
+
+		c.Write([]byte{socks5Version, 0, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), true
+	}
+}
@@ -3,13 +3,12 @@
 package websocket
 
 import (
-	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"strings"
+	"sync/atomic"
 	"time"
 
 	"nhooyr.io/websocket/internal/errd"
@@ -75,6 +74,28 @@ func (c *Conn) SetReadLimit(n int64) {
 	c.msgReader.limitReader.limit.Store(n + 1)
 }
 
+// SetWireReadLimit sets the max number of payload bytes to receive for a single
+// message. It differs from the read limit for compressed messages and
+// is checked before the payload of every frame is read.
+//
+// By default, there is no wire read limit.
+//
+// When the limit is hit, the connection will be closed with StatusMessageTooBig.
+func (c *Conn) SetWireReadLimit(n int64) {
+	c.msgReader.wireLimit.Store(n)
+}
+
+// SetReadExpansionLimit sets the max ratio of the bytes read of a single message
+// to the payload bytes received for it. It protects against compressed
+// messages that inflate to far more than they would reasonably contain.
+//
+// By default, there is no read expansion limit.
+//
+// When the limit is hit, the connection will be closed with StatusMessageTooBig.
+func (c *Conn) SetReadExpansionLimit(ratio int64) {
+	c.msgReader.expansionLimit.Store(ratio)
+}
+
 const defaultReadLimit = 32768
 
 func newMsgReader(c *Conn) *msgReader {
@@ -88,33 +109,8 @@ func newMsgReader(c *Conn) *msgReader {
 	return mr
 }
 
-func (mr *msgReader) resetFlate() {
-	if mr.flateContextTakeover() {
-		mr.dict.init(32768)
-	}
-	if mr.flateBufio == nil {
-		mr.flateBufio = getBufioReader(mr.readFunc)
-	}
-
-	mr.flateReader = getFlateReader(mr.flateBufio, mr.dict.buf)
-	mr.limitReader.r = mr.flateReader
-	mr.flateTail.Reset(deflateMessageTail)
-}
-
-func (mr *msgReader) putFlateReader() {
-	if mr.flateReader != nil {
-		putFlateReader(mr.flateReader)
-		mr.flateReader = nil
-	}
-}
-
 func (mr *msgReader) close() {
 	mr.c.readMu.forceLock()
-	mr.putFlateReader()
-	mr.dict.close()
-	if mr.flateBufio != nil {
-		putBufioReader(mr.flateBufio)
-	}
 
 	if mr.c.client {
 		putBufioReader(mr.c.br)
@@ -122,34 +118,16 @@ func (mr *msgReader) close() {
 	}
 }
 
-func (mr *msgReader) flateContextTakeover() bool {
-	if mr.c.client {
-		return !mr.c.copts.serverNoContextTakeover
-	}
-	return !mr.c.copts.clientNoContextTakeover
-}
-
-func (c *Conn) readRSV1Illegal(h header) bool {
-	// If compression is disabled, rsv1 is illegal.
-	if !c.flate() {
-		return true
-	}
-	// rsv1 is only allowed on data frames beginning messages.
-	if h.opcode != opText && h.opcode != opBinary {
-		return true
-	}
-	return false
-}
-
 func (c *Conn) readLoop(ctx context.Context) (header, error) {
 	for {
 		h, err := c.readFrameHeader(ctx)
 		if err != nil {
 			return header{}, err
 		}
+		atomic.StoreInt32(&c.readActivity, 1)
 
-		if h.rsv1 && c.readRSV1Illegal(h) || h.rsv2 || h.rsv3 {
-			err := fmt.Errorf("received header with unexpected rsv bits set: %v:%v:%v", h.rsv1, h.rsv2, h.rsv3)
+		err = c.checkRSV(h)
+		if err != nil {
 			c.writeError(StatusProtocolError, err)
 			return header{}, err
 		}
@@ -171,9 +149,16 @@ func (c *Conn) readLoop(ctx context.Context) (header, error) {
 		case opContinuation, opText, opBinary:
 			return h, nil
 		default:
-			err := fmt.Errorf("received unknown opcode %v", h.opcode)
-			c.writeError(StatusProtocolError, err)
-			return header{}, err
+			ec, ok := c.frameHandlers[h.opcode]
+			if !ok {
+				err := fmt.Errorf("received unknown opcode %v", h.opcode)
+				c.writeError(StatusProtocolError, err)
+				return header{}, err
+			}
+			err = c.handleExtensionFrame(ctx, h, ec)
+			if err != nil {
+				return header{}, err
+			}
 		}
 	}
 }
@@ -250,7 +235,7 @@ func (c *Conn) handleControl(ctx context.Context, h header) (err error) {
 		return err
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	ctx, cancel := withTimeout(ctx, c.controlTimeout)
 	defer cancel()
 
 	b := c.readControlBuf[:h.payloadLength]
@@ -265,13 +250,29 @@ func (c *Conn) handleControl(ctx context.Context, h header) (err error) {
 
 	switch h.opcode {
 	case opPing:
+		if c.onPing != nil {
+			c.onPing(b)
+		}
+		c.closeMu.Lock()
+		wroteClose := c.wroteClose
+		c.closeMu.Unlock()
+		if wroteClose {
+			// The close frame must be the last frame we send.
+			return nil
+		}
 		return c.writeControl(ctx, opPong, b)
 	case opPong:
 		c.activePingsMu.Lock()
-		pong, ok := c.activePings[string(b)]
+		ap, ok := c.activePings[string(b)]
+		// Delete it so that a duplicate pong does not close it again.
+		delete(c.activePings, string(b))
 		c.activePingsMu.Unlock()
 		if ok {
-			close(pong)
+			c.updateRTT(time.Since(ap.sent))
+			close(ap.pong)
+		}
+		if c.onPong != nil {
+			c.onPong(b)
 		}
 		return nil
 	}
@@ -287,9 +288,14 @@ func (c *Conn) handleControl(ctx context.Context, h header) (err error) {
 		return err
 	}
 
+	c.closeMu.Lock()
+	c.closeInfo.Received = &ce
+	c.setCloseInitiatorLocked(CloseInitiatorPeer)
+	c.closeMu.Unlock()
+
 	err = fmt.Errorf("received close frame: %w", ce)
 	c.setCloseErr(err)
-	c.writeClose(ce.Code, ce.Reason)
+	c.writeClose(context.Background(), ce.Code, ce.Reason)
 	c.close(err)
 	return err
 }
@@ -320,7 +326,10 @@ func (c *Conn) reader(ctx context.Context) (_ MessageType, _ io.Reader, err erro
 		return 0, nil, err
 	}
 
-	c.msgReader.reset(ctx, h)
+	err = c.msgReader.reset(ctx, h)
+	if err != nil {
+		return 0, nil, err
+	}
 
 	return MessageType(h.opcode), c.msgReader, nil
 }
@@ -329,37 +338,69 @@ type msgReader struct {
 	c *Conn
 
 	ctx         context.Context
-	flate       bool
-	flateReader io.Reader
-	flateBufio  *bufio.Reader
-	flateTail   strings.Reader
 	limitReader *limitReader
-	dict        slidingWindow
 
 	fin           bool
+	rsv           RSV
 	payloadLength int64
 	maskKey       uint32
 
+	wireLimit      xsync.Int64
+	expansionLimit xsync.Int64
+	// wireLength is the payload length of the frames of the message so far
+	// and wireRead how much of it has been read.
+	wireLength int64
+	wireRead   int64
+	// n is the number of bytes read of the message.
+	n int64
+
+	// Frame transformers need entire frames.
+	transformFrame bool
+	frame          []byte
+	frameBuf       []byte
+
 	// readerFunc(mr.Read) to avoid continuous allocations.
 	readFunc readerFunc
 }
 
-func (mr *msgReader) reset(ctx context.Context, h header) {
+func (mr *msgReader) reset(ctx context.Context, h header) (err error) {
 	mr.ctx = ctx
-	mr.flate = h.rsv1
-	mr.limitReader.reset(mr.readFunc)
-
-	if mr.flate {
-		mr.resetFlate()
+	mr.wireLength = 0
+	mr.wireRead = 0
+	mr.n = 0
+	err = mr.setFrame(h)
+	if err != nil {
+		return err
 	}
 
-	mr.setFrame(h)
+	var r io.Reader = mr.readFunc
+	ts := mr.c.msgTransformers
+	for i := len(ts) - 1; i >= 0; i-- {
+		r, err = ts[i].ReadMessage(r, MessageType(h.opcode), mr.rsv)
+		if err != nil {
+			err = fmt.Errorf("failed to transform message: %w", err)
+			mr.c.writeError(StatusProtocolError, err)
+			return err
+		}
+	}
+	mr.limitReader.reset(r)
+	return nil
 }
 
-func (mr *msgReader) setFrame(h header) {
+func (mr *msgReader) setFrame(h header) error {
 	mr.fin = h.fin
+	mr.rsv = h.rsv()
 	mr.payloadLength = h.payloadLength
 	mr.maskKey = h.maskKey
+	mr.transformFrame = len(mr.c.frameTransformers) > 0
+
+	mr.wireLength += h.payloadLength
+	if limit := mr.wireLimit.Load(); limit > 0 && mr.wireLength > limit {
+		err := ReadLimitError{Limit: ReadLimitWire, Max: limit}
+		mr.c.writeError(StatusMessageTooBig, err)
+		return err
+	}
+	return nil
 }
 
 func (mr *msgReader) Read(p []byte) (n int, err error) {
@@ -370,12 +411,12 @@ func (mr *msgReader) Read(p []byte) (n int, err error) {
 	defer mr.c.readMu.unlock()
 
 	n, err = mr.limitReader.Read(p)
-	if mr.flate && mr.flateContextTakeover() {
-		p = p[:n]
-		mr.dict.write(p)
+	mr.n += int64(n)
+	if limit := mr.expansionLimit.Load(); limit > 0 && mr.n > limit*mr.wireRead {
+		err = ReadLimitError{Limit: ReadLimitExpansion, Max: limit}
+		mr.c.writeError(StatusMessageTooBig, err)
 	}
-	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) && mr.fin && mr.flate {
-		mr.putFlateReader()
+	if errors.Is(err, io.EOF) {
 		return n, io.EOF
 	}
 	if err != nil {
@@ -387,11 +428,22 @@ func (mr *msgReader) Read(p []byte) (n int, err error) {
 
 func (mr *msgReader) read(p []byte) (int, error) {
 	for {
+		if len(mr.frame) > 0 {
+			n := copy(p, mr.frame)
+			mr.frame = mr.frame[n:]
+			return n, nil
+		}
+
+		if mr.transformFrame {
+			err := mr.readTransformedFrame()
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+
 		if mr.payloadLength == 0 {
 			if mr.fin {
-				if mr.flate {
-					return mr.flateTail.Read(p)
-				}
 				return 0, io.EOF
 			}
 
@@ -404,7 +456,10 @@ func (mr *msgReader) read(p []byte) (int, error) {
 				mr.c.writeError(StatusProtocolError, err)
 				return 0, err
 			}
-			mr.setFrame(h)
+			err = mr.setFrame(h)
+			if err != nil {
+				return 0, err
+			}
 
 			continue
 		}
@@ -419,6 +474,7 @@ func (mr *msgReader) read(p []byte) (int, error) {
 		}
 
 		mr.payloadLength -= int64(n)
+		mr.wireRead += int64(n)
 
 		if !mr.c.client {
 			mr.maskKey = mask(mr.maskKey, p)
@@ -428,6 +484,49 @@ func (mr *msgReader) read(p []byte) (int, error) {
 	}
 }
 
+// readTransformedFrame reads the entire payload of the current
+// frame and passes it through the frame transformers.
+func (mr *msgReader) readTransformedFrame() error {
+	if limit := mr.limitReader.limit.Load(); mr.payloadLength > limit {
+		err := ReadLimitError{Limit: ReadLimitMessage, Max: limit - 1}
+		mr.c.writeError(StatusMessageTooBig, err)
+		return err
+	}
+
+	if int64(cap(mr.frameBuf)) < mr.payloadLength {
+		mr.frameBuf = make([]byte, mr.payloadLength)
+	}
+	b := mr.frameBuf[:mr.payloadLength]
+
+	_, err := mr.c.readFramePayload(mr.ctx, b)
+	if err != nil {
+		return err
+	}
+	mr.wireRead += mr.payloadLength
+	mr.payloadLength = 0
+	mr.transformFrame = false
+
+	if !mr.c.client {
+		mr.maskKey = mask(mr.maskKey, b)
+	}
+
+	ts := mr.c.frameTransformers
+	for i := len(ts) - 1; i >= 0; i-- {
+		b, err = ts[i].ReadFrame(b, mr.rsv, mr.fin)
+		if err != nil {
+			code := StatusProtocolError
+			if errors.As(err, &ReadLimitError{}) {
+				code = StatusMessageTooBig
+			}
+			err = fmt.Errorf("failed to transform frame: %w", err)
+			mr.c.writeError(code, err)
+			return err
+		}
+	}
+	mr.frame = b
+	return nil
+}
+
 type limitReader struct {
 	c     *Conn
 	r     io.Reader
@@ -451,7 +550,7 @@ func (lr *limitReader) reset(r io.Reader) {
 
 func (lr *limitReader) Read(p []byte) (int, error) {
 	if lr.n <= 0 {
-		err := fmt.Errorf("read limited at %v bytes", lr.limit.Load())
+		err := ReadLimitError{Limit: ReadLimitMessage, Max: lr.limit.Load() - 1}
 		lr.c.writeError(StatusMessageTooBig, err)
 		return 0, err
 	}
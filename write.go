@@ -10,9 +10,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"time"
-
-	"github.com/klauspost/compress/flate"
 
 	"nhooyr.io/websocket/internal/errd"
 )
@@ -25,7 +22,12 @@ import (
 // Only one writer can be open at a time, multiple calls will block until the previous writer
 // is closed.
 func (c *Conn) Writer(ctx context.Context, typ MessageType) (io.WriteCloser, error) {
-	w, err := c.writer(ctx, typ)
+	return c.WriterWithOptions(ctx, typ, nil)
+}
+
+// WriterWithOptions is like Writer but with options for the message.
+func (c *Conn) WriterWithOptions(ctx context.Context, typ MessageType, opts *WriteOptions) (io.WriteCloser, error) {
+	w, err := c.writer(ctx, typ, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get writer: %w", err)
 	}
@@ -39,13 +41,36 @@ func (c *Conn) Writer(ctx context.Context, typ MessageType) (io.WriteCloser, err
 // If compression is disabled or the threshold is not met, then it
 // will write the message in a single frame.
 func (c *Conn) Write(ctx context.Context, typ MessageType, p []byte) error {
-	_, err := c.write(ctx, typ, p)
+	return c.WriteWithOptions(ctx, typ, p, nil)
+}
+
+// WriteWithOptions is like Write but with options for the message.
+func (c *Conn) WriteWithOptions(ctx context.Context, typ MessageType, p []byte, opts *WriteOptions) error {
+	_, err := c.write(ctx, typ, p, opts)
 	if err != nil {
 		return fmt.Errorf("failed to write msg: %w", err)
 	}
 	return nil
 }
 
+// WriteOptions represents the options for writing a message.
+type WriteOptions struct {
+	// Compression overrides whether the message is compressed.
+	// The message is only ever compressed if compression was negotiated.
+	//
+	// Defaults to MessageCompressionDefault.
+	Compression MessageCompression
+}
+
+// messageCompressor is implemented by message transformers that compress
+// messages so WriteOptions.Compression can override them.
+type messageCompressor interface {
+	// shouldCompress reports whether the message should be compressed
+	// by default given its first write.
+	shouldCompress(typ MessageType, p []byte) bool
+	compressMessage(w io.Writer, typ MessageType) (io.WriteCloser, RSV, error)
+}
+
 type msgWriter struct {
 	mw     *msgWriterState
 	closed bool
@@ -72,12 +97,18 @@ type msgWriterState struct {
 	mu      *mu
 	writeMu *mu
 
-	ctx    context.Context
-	opcode opcode
-	flate  bool
+	ctx         context.Context
+	opcode      opcode
+	compression MessageCompression
+	rsv         RSV
+	started     bool
 
-	trimWriter *trimLastFourBytesWriter
-	dict       slidingWindow
+	// w is the message transformer chain if any transform the message.
+	w       io.Writer
+	closers []io.WriteCloser
+
+	// writerFunc(mw.write) to avoid continuous allocations.
+	writeFunc writerFunc
 }
 
 func newMsgWriterState(c *Conn) *msgWriterState {
@@ -86,29 +117,12 @@ func newMsgWriterState(c *Conn) *msgWriterState {
 		mu:      newMu(c),
 		writeMu: newMu(c),
 	}
+	mw.writeFunc = mw.write
 	return mw
 }
 
-func (mw *msgWriterState) ensureFlate() {
-	if mw.trimWriter == nil {
-		mw.trimWriter = &trimLastFourBytesWriter{
-			w: writerFunc(mw.write),
-		}
-	}
-
-	mw.dict.init(8192)
-	mw.flate = true
-}
-
-func (mw *msgWriterState) flateContextTakeover() bool {
-	if mw.c.client {
-		return !mw.c.copts.clientNoContextTakeover
-	}
-	return !mw.c.copts.serverNoContextTakeover
-}
-
-func (c *Conn) writer(ctx context.Context, typ MessageType) (io.WriteCloser, error) {
-	err := c.msgWriterState.reset(ctx, typ)
+func (c *Conn) writer(ctx context.Context, typ MessageType, opts *WriteOptions) (io.WriteCloser, error) {
+	err := c.msgWriterState.reset(ctx, typ, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -118,15 +132,15 @@ func (c *Conn) writer(ctx context.Context, typ MessageType) (io.WriteCloser, err
 	}, nil
 }
 
-func (c *Conn) write(ctx context.Context, typ MessageType, p []byte) (int, error) {
-	mw, err := c.writer(ctx, typ)
+func (c *Conn) write(ctx context.Context, typ MessageType, p []byte, opts *WriteOptions) (int, error) {
+	mw, err := c.writer(ctx, typ, opts)
 	if err != nil {
 		return 0, err
 	}
 
-	if !c.flate() {
+	if len(c.msgTransformers) == 0 {
 		defer c.msgWriterState.mu.unlock()
-		return c.writeFrame(ctx, true, false, c.msgWriterState.opcode, p)
+		return c.writeFrame(ctx, true, 0, c.msgWriterState.opcode, p)
 	}
 
 	n, err := mw.Write(p)
@@ -138,7 +152,7 @@ func (c *Conn) write(ctx context.Context, typ MessageType, p []byte) (int, error
 	return n, err
 }
 
-func (mw *msgWriterState) reset(ctx context.Context, typ MessageType) error {
+func (mw *msgWriterState) reset(ctx context.Context, typ MessageType, opts *WriteOptions) error {
 	err := mw.mu.lock(ctx)
 	if err != nil {
 		return err
@@ -146,13 +160,59 @@ func (mw *msgWriterState) reset(ctx context.Context, typ MessageType) error {
 
 	mw.ctx = ctx
 	mw.opcode = opcode(typ)
-	mw.flate = false
+	mw.compression = MessageCompressionDefault
+	if opts != nil {
+		mw.compression = opts.Compression
+	}
+	mw.rsv = 0
+	mw.started = false
+	mw.w = nil
+	mw.closers = mw.closers[:0]
 
-	mw.trimWriter.reset()
+	return nil
+}
 
+// transform sets up the message transformers that
+// transform the message being written given its first write.
+func (mw *msgWriterState) transform(p []byte) error {
+	var w io.Writer = mw.writeFunc
+	ts := mw.c.msgTransformers
+	for i := len(ts) - 1; i >= 0; i-- {
+		wc, rsv, err := mw.transformMessage(ts[i], w, p)
+		if err != nil {
+			return fmt.Errorf("failed to transform message: %w", err)
+		}
+		if wc == nil {
+			continue
+		}
+		mw.rsv |= rsv
+		mw.closers = append(mw.closers, wc)
+		w = wc
+	}
+	if len(mw.closers) > 0 {
+		mw.w = w
+	}
 	return nil
 }
 
+func (mw *msgWriterState) transformMessage(t MessageTransformer, w io.Writer, p []byte) (io.WriteCloser, RSV, error) {
+	typ := MessageType(mw.opcode)
+	mc, ok := t.(messageCompressor)
+	if !ok {
+		return t.WriteMessage(w, typ, len(p))
+	}
+	switch mw.compression {
+	case MessageCompressionForce:
+	case MessageCompressionSkip:
+		return nil, 0, nil
+	default:
+		if !mc.shouldCompress(typ, p) {
+			return nil, 0, nil
+		}
+	}
+	return mc.compressMessage(w, typ)
+}
+
 // Write writes the given bytes to the WebSocket connection.
 func (mw *msgWriterState) Write(p []byte) (_ int, err error) {
 	err = mw.writeMu.lock(mw.ctx)
@@ -168,28 +228,22 @@ func (mw *msgWriterState) Write(p []byte) (_ int, err error) {
 		}
 	}()
 
-	if mw.c.flate() {
-		// Only enables flate if the length crosses the
-		// threshold on the first frame
-		if mw.opcode != opContinuation && len(p) >= mw.c.flateThreshold {
-			mw.ensureFlate()
-		}
-	}
-
-	if mw.flate {
-		err = flate.StatelessDeflate(mw.trimWriter, p, false, mw.dict.buf)
+	if !mw.started {
+		mw.started = true
+		err = mw.transform(p)
 		if err != nil {
 			return 0, err
 		}
-		mw.dict.write(p)
-		return len(p), nil
 	}
 
+	if mw.w != nil {
+		return mw.w.Write(p)
+	}
 	return mw.write(p)
 }
 
 func (mw *msgWriterState) write(p []byte) (int, error) {
-	n, err := mw.c.writeFrame(mw.ctx, false, mw.flate, mw.opcode, p)
+	n, err := mw.c.writeFrame(mw.ctx, false, mw.rsv, mw.opcode, p)
 	if err != nil {
 		return n, fmt.Errorf("failed to write data frame: %w", err)
 	}
@@ -207,33 +261,38 @@ func (mw *msgWriterState) Close() (err error) {
 	}
 	defer mw.writeMu.unlock()
 
-	_, err = mw.c.writeFrame(mw.ctx, true, mw.flate, mw.opcode, nil)
+	for i := len(mw.closers) - 1; i >= 0; i-- {
+		err = mw.closers[i].Close()
+		if err != nil {
+			err = fmt.Errorf("failed to close message transformer: %w", err)
+			mw.c.close(err)
+			return err
+		}
+	}
+
+	_, err = mw.c.writeFrame(mw.ctx, true, mw.rsv, mw.opcode, nil)
 	if err != nil {
 		return fmt.Errorf("failed to write fin frame: %w", err)
 	}
 
-	if mw.flate && !mw.flateContextTakeover() {
-		mw.dict.close()
-	}
 	mw.mu.unlock()
 	return nil
 }
 
 func (mw *msgWriterState) close() {
+	mw.c.writeFrameMu.forceLock()
 	if mw.c.client {
-		mw.c.writeFrameMu.forceLock()
 		putBufioWriter(mw.c.bw)
 	}
 
 	mw.writeMu.forceLock()
-	mw.dict.close()
 }
 
 func (c *Conn) writeControl(ctx context.Context, opcode opcode, p []byte) error {
-	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	ctx, cancel := withTimeout(ctx, c.controlTimeout)
 	defer cancel()
 
-	_, err := c.writeFrame(ctx, true, false, opcode, p)
+	_, err := c.writeFrame(ctx, true, 0, opcode, p)
 	if err != nil {
 		return fmt.Errorf("failed to write control frame %v: %w", opcode, err)
 	}
@@ -241,7 +300,7 @@ func (c *Conn) writeControl(ctx context.Context, opcode opcode, p []byte) error
 }
 
 // frame handles all writes to the connection.
-func (c *Conn) writeFrame(ctx context.Context, fin bool, flate bool, opcode opcode, p []byte) (_ int, err error) {
+func (c *Conn) writeFrame(ctx context.Context, fin bool, rsv RSV, opcode opcode, p []byte) (_ int, err error) {
 	err = c.writeFrameMu.lock(ctx)
 	if err != nil {
 		return 0, err
@@ -265,6 +324,25 @@ func (c *Conn) writeFrame(ctx context.Context, fin bool, flate bool, opcode opco
 		}
 	}
 
+	// Message reserved bits are only set on the first frame.
+	if opcode != opText && opcode != opBinary {
+		rsv &^= c.msgRSV
+	}
+
+	n := len(p)
+	if opcode == opContinuation || opcode == opText || opcode == opBinary {
+		for _, ft := range c.frameTransformers {
+			var frameRSV RSV
+			p, frameRSV, err = ft.WriteFrame(p, fin)
+			if err != nil {
+				err = fmt.Errorf("failed to transform frame: %w", err)
+				c.close(err)
+				return 0, err
+			}
+			rsv |= frameRSV
+		}
+	}
+
 	select {
 	case <-c.closed:
 		return 0, c.closeErr
@@ -297,19 +375,18 @@ func (c *Conn) writeFrame(ctx context.Context, fin bool, flate bool, opcode opco
 		c.writeHeader.maskKey = binary.LittleEndian.Uint32(c.writeHeaderBuf[:])
 	}
 
-	c.writeHeader.rsv1 = false
-	if flate && (opcode == opText || opcode == opBinary) {
-		c.writeHeader.rsv1 = true
-	}
+	c.writeHeader.rsv1 = rsv&RSV1 != 0
+	c.writeHeader.rsv2 = rsv&RSV2 != 0
+	c.writeHeader.rsv3 = rsv&RSV3 != 0
 
 	err = writeFrameHeader(c.writeHeader, c.bw, c.writeHeaderBuf[:])
 	if err != nil {
 		return 0, err
 	}
 
-	n, err := c.writeFramePayload(p)
+	_, err = c.writeFramePayload(p)
 	if err != nil {
-		return n, err
+		return 0, err
 	}
 
 	if c.writeHeader.fin {
@@ -392,6 +469,6 @@ func extractBufioWriterBuf(bw *bufio.Writer, w io.Writer) []byte {
 
 func (c *Conn) writeError(code StatusCode, err error) {
 	c.setCloseErr(err)
-	c.writeClose(code, err.Error())
+	c.writeClose(context.Background(), code, err.Error())
 	c.close(nil)
 }
@@ -6,12 +6,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"reflect"
 	"runtime"
 	"strings"
 	"sync"
 	"syscall/js"
+	"time"
 
 	"nhooyr.io/websocket/internal/bpool"
 	"nhooyr.io/websocket/internal/wsjs"
@@ -32,6 +34,8 @@ type Conn struct {
 	closeErrOnce  sync.Once
 	closeErr      error
 	closeWasClean bool
+	closeInfoMu   sync.Mutex
+	closeInfo     CloseInfo
 
 	releaseOnClose   func()
 	releaseOnMessage func()
@@ -45,6 +49,19 @@ func (c *Conn) close(err error, wasClean bool) {
 	c.closeOnce.Do(func() {
 		runtime.SetFinalizer(c, nil)
 
+		c.closeInfoMu.Lock()
+		c.closeInfo.Clean = wasClean
+		var ce CloseError
+		if wasClean && errors.As(err, &ce) {
+			// The code and reason of a clean close
+			// are those of the peer's close frame.
+			c.closeInfo.Received = &ce
+			if c.closeInfo.Initiator == CloseInitiatorNone {
+				c.closeInfo.Initiator = CloseInitiatorPeer
+			}
+		}
+		c.closeInfoMu.Unlock()
+
 		if !wasClean {
 			err = fmt.Errorf("unclean connection close: %w", err)
 		}
@@ -109,7 +126,7 @@ func (c *Conn) Read(ctx context.Context) (MessageType, []byte, error) {
 		return 0, nil, fmt.Errorf("failed to read: %w", err)
 	}
 	if int64(len(p)) > c.msgReadLimit.Load() {
-		err := fmt.Errorf("read limited at %v bytes", c.msgReadLimit.Load())
+		err := ReadLimitError{Limit: ReadLimitMessage, Max: c.msgReadLimit.Load()}
 		c.Close(StatusMessageTooBig, err.Error())
 		return 0, nil, err
 	}
@@ -158,6 +175,22 @@ func (c *Conn) Ping(ctx context.Context) error {
 	return nil
 }
 
+// PingPayload is mocked out for Wasm.
+func (c *Conn) PingPayload(ctx context.Context, p []byte) error {
+	return nil
+}
+
+// Pong is mocked out for Wasm.
+func (c *Conn) Pong(ctx context.Context, p []byte) error {
+	return nil
+}
+
+// RTT is mocked out for Wasm.
+// It always returns 0 as browsers do not expose pings.
+func (c *Conn) RTT() time.Duration {
+	return 0
+}
+
 // Write writes a message of the given type to the connection.
 // Always non blocking.
 func (c *Conn) Write(ctx context.Context, typ MessageType, p []byte) error {
@@ -175,6 +208,17 @@ func (c *Conn) Write(ctx context.Context, typ MessageType, p []byte) error {
 	return nil
 }
 
+// WriteWithOptions is like Write. The options are ignored
+// as the browser decides whether to compress messages.
+func (c *Conn) WriteWithOptions(ctx context.Context, typ MessageType, p []byte, opts *WriteOptions) error {
+	return c.Write(ctx, typ, p)
+}
+
+// WriteOptions represents the options for writing a message.
+type WriteOptions struct {
+	Compression MessageCompression
+}
+
 func (c *Conn) write(ctx context.Context, typ MessageType, p []byte) error {
 	if c.isClosed() {
 		return c.closeErr
@@ -194,14 +238,20 @@ func (c *Conn) write(ctx context.Context, typ MessageType, p []byte) error {
 // or the connection is closed.
 // It thus performs the full WebSocket close handshake.
 func (c *Conn) Close(code StatusCode, reason string) error {
-	err := c.exportedClose(code, reason)
+	return c.CloseContext(context.Background(), code, reason)
+}
+
+// CloseContext is like Close but stops waiting for the close
+// handshake once ctx is done.
+func (c *Conn) CloseContext(ctx context.Context, code StatusCode, reason string) error {
+	err := c.exportedClose(ctx, code, reason)
 	if err != nil {
 		return fmt.Errorf("failed to close WebSocket: %w", err)
 	}
 	return nil
 }
 
-func (c *Conn) exportedClose(code StatusCode, reason string) error {
+func (c *Conn) exportedClose(ctx context.Context, code StatusCode, reason string) error {
 	c.closingMu.Lock()
 	defer c.closingMu.Unlock()
 
@@ -215,18 +265,63 @@ func (c *Conn) exportedClose(code StatusCode, reason string) error {
 	}
 
 	c.setCloseErr(ce)
+	c.setCloseSent(code, reason)
 	err := c.ws.Close(int(code), reason)
 	if err != nil {
 		return err
 	}
 
-	<-c.closed
+	select {
+	case <-c.closed:
+	case <-ctx.Done():
+		return fmt.Errorf("failed to wait for close: %w", ctx.Err())
+	}
 	if !c.closeWasClean {
 		return c.closeErr
 	}
 	return nil
 }
 
+// CloseNow closes the connection without waiting for the close handshake.
+// The browser still performs it in the background with StatusNormalClosure.
+func (c *Conn) CloseNow() error {
+	if c.isClosed() {
+		return nil
+	}
+
+	c.setCloseSent(StatusNormalClosure, "")
+	err := c.ws.Close(int(StatusNormalClosure), "")
+	c.close(errors.New("closed without waiting for the close handshake"), false)
+	if err != nil {
+		return fmt.Errorf("failed to close WebSocket: %w", err)
+	}
+	return nil
+}
+
+func (c *Conn) setCloseSent(code StatusCode, reason string) {
+	c.closeInfoMu.Lock()
+	c.closeInfo.Sent = &CloseError{
+		Code:   code,
+		Reason: reason,
+	}
+	if c.closeInfo.Initiator == CloseInitiatorNone {
+		c.closeInfo.Initiator = CloseInitiatorLocal
+	}
+	c.closeInfoMu.Unlock()
+}
+
+// CloseInfo describes how the connection was closed. It is only
+// complete once the connection is closed.
+func (c *Conn) CloseInfo() CloseInfo {
+	c.closeInfoMu.Lock()
+	defer c.closeInfoMu.Unlock()
+	return c.closeInfo
+}
+
+func (c *Conn) netAddrs() (local, remote net.Addr) {
+	return nil, nil
+}
+
 // Subprotocol returns the negotiated subprotocol.
 // An empty string means the default protocol.
 func (c *Conn) Subprotocol() string {
@@ -310,6 +405,12 @@ func (c *Conn) Writer(ctx context.Context, typ MessageType) (io.WriteCloser, err
 	}, nil
 }
 
+// WriterWithOptions is like Writer. The options are ignored
+// as the browser decides whether to compress messages.
+func (c *Conn) WriterWithOptions(ctx context.Context, typ MessageType, opts *WriteOptions) (io.WriteCloser, error) {
+	return c.Writer(ctx, typ)
+}
+
 type writer struct {
 	closed bool
 
@@ -363,6 +464,16 @@ func (c *Conn) SetReadLimit(n int64) {
 	c.msgReadLimit.Store(n)
 }
 
+// SetWireReadLimit is a noop for wasm as the browser
+// does not expose the payload bytes of messages.
+func (c *Conn) SetWireReadLimit(n int64) {
+}
+
+// SetReadExpansionLimit is a noop for wasm as the browser
+// does not expose the payload bytes of messages.
+func (c *Conn) SetReadExpansionLimit(ratio int64) {
+}
+
 func (c *Conn) setCloseErr(err error) {
 	c.closeErrOnce.Do(func() {
 		c.closeErr = fmt.Errorf("WebSocket closed: %w", err)
@@ -0,0 +1,526 @@
+// +build !js
+
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// zstdWindowSize is the window messages are compressed with. It matches
+	// the largest deflate window to bound the memory held by connections
+	// with context takeover.
+	zstdWindowSize = 1 << 15
+	// zstdMaxBlockSize is the most a zstd block decompresses to.
+	// See https://tools.ietf.org/html/rfc8878#section-3.1.1.2.3
+	zstdMaxBlockSize = 128 << 10
+	// zstdMaxLevel is the highest level of the zstd command.
+	zstdMaxLevel = 22
+)
+
+func verifyZstdOptions(opts *ZstdOptions) error {
+	if opts == nil {
+		return nil
+	}
+	if opts.Level < 0 || opts.Level > zstdMaxLevel {
+		return fmt.Errorf("Zstd.Level must be between 1 and %v: %v", zstdMaxLevel, opts.Level)
+	}
+	return nil
+}
+
+// zstdDict is a pre-shared dictionary identified by its id in the
+// dict_id parameter and the header of every zstd frame.
+type zstdDict struct {
+	id      uint32
+	content []byte
+	// raw is set if content is not in the zstd dictionary format.
+	raw bool
+}
+
+func newZstdDict(b []byte) *zstdDict {
+	if len(b) == 0 {
+		return nil
+	}
+	if info, err := zstd.InspectDictionary(b); err == nil && info.ID() != 0 {
+		return &zstdDict{id: info.ID(), content: b}
+	}
+	id := crc32.ChecksumIEEE(b)
+	if id == 0 {
+		// 0 means no dictionary in a frame header.
+		id = 1
+	}
+	return &zstdDict{id: id, content: b, raw: true}
+}
+
+// zstdExtension implements the experimental permessage-zstd extension.
+//
+// Its parameters are those of permessage-deflate without the window bits
+// as the window is fixed, and dict_id which the client offers with the id
+// of its pre-shared dictionary and the server responds with if it has the
+// same dictionary.
+type zstdExtension struct {
+	mode      CompressionMode
+	threshold int
+	level     zstd.EncoderLevel
+	dict      *zstdDict
+}
+
+var _ Extension = zstdExtension{}
+
+func newZstdExtension(opts *ZstdOptions) zstdExtension {
+	level := opts.Level
+	if level == 0 {
+		level = 3
+	}
+	return zstdExtension{
+		mode:      opts.Mode,
+		threshold: opts.Threshold,
+		level:     zstd.EncoderLevelFromZstd(level),
+		dict:      newZstdDict(opts.Dictionary),
+	}
+}
+
+func (e zstdExtension) Name() string {
+	return "x-permessage-zstd"
+}
+
+func (e zstdExtension) params(copts *compressionOptions, dict *zstdDict) []string {
+	params := copts.params()
+	if dict != nil {
+		params = append(params, fmt.Sprintf("dict_id=%d", dict.id))
+	}
+	return params
+}
+
+func (e zstdExtension) Offer() []string {
+	return e.params(e.mode.opts(), e.dict)
+}
+
+// Accept declines offers with unknown or invalid parameters so that
+// the client's next offer may be accepted.
+func (e zstdExtension) Accept(params []string) (ExtensionConn, []string, error) {
+	copts := e.mode.opts()
+
+	var dict *zstdDict
+	for _, p := range params {
+		name, value := splitExtensionParam(p)
+		switch name {
+		case "client_no_context_takeover":
+			copts.clientNoContextTakeover = true
+		case "server_no_context_takeover":
+			copts.serverNoContextTakeover = true
+		case "dict_id":
+			id, err := parseDictionaryID(value)
+			if err != nil {
+				return nil, nil, nil
+			}
+			if e.dict != nil && e.dict.id == id {
+				dict = e.dict
+			}
+		default:
+			return nil, nil, nil
+		}
+	}
+
+	return e.newConn(copts, dict, false), e.params(copts, dict), nil
+}
+
+func (e zstdExtension) Negotiated(params []string) (ExtensionConn, error) {
+	copts := e.mode.opts()
+
+	var dict *zstdDict
+	for _, p := range params {
+		name, value := splitExtensionParam(p)
+		var err error
+		switch name {
+		case "client_no_context_takeover":
+			copts.clientNoContextTakeover = true
+		case "server_no_context_takeover":
+			copts.serverNoContextTakeover = true
+		case "dict_id":
+			var id uint32
+			id, err = parseDictionaryID(value)
+			if err == nil && (e.dict == nil || e.dict.id != id) {
+				err = errors.New("unexpected")
+			}
+			dict = e.dict
+		default:
+			err = errors.New("unsupported")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v x-permessage-zstd parameter: %q", err, p)
+		}
+	}
+
+	return e.newConn(copts, dict, true), nil
+}
+
+// zstdConn is the permessage-zstd state of a connection.
+type zstdConn struct {
+	threshold int
+	level     zstd.EncoderLevel
+	dict      *zstdDict
+
+	zw zstdWriter
+	zr zstdReader
+}
+
+var _ MessageTransformer = &zstdConn{}
+var _ messageCompressor = &zstdConn{}
+
+func (e zstdExtension) newConn(copts *compressionOptions, dict *zstdDict, client bool) *zstdConn {
+	zc := &zstdConn{
+		threshold: e.threshold,
+		level:     e.level,
+		dict:      dict,
+	}
+	zc.zw.contextTakeover = !copts.serverNoContextTakeover
+	zc.zr.contextTakeover = !copts.clientNoContextTakeover
+	if client {
+		zc.zw.contextTakeover = !copts.clientNoContextTakeover
+		zc.zr.contextTakeover = !copts.serverNoContextTakeover
+	}
+	if zc.threshold == 0 {
+		zc.threshold = 128
+		if !zc.zw.contextTakeover {
+			zc.threshold = 512
+		}
+	}
+	zc.zw.zc = zc
+	zc.zr.zc = zc
+	return zc
+}
+
+func (zc *zstdConn) RSV() RSV {
+	return RSV1
+}
+
+func (zc *zstdConn) Close() error {
+	zc.zw.close()
+	zc.zr.close()
+	return nil
+}
+
+func (zc *zstdConn) WriteMessage(w io.Writer, typ MessageType, sizeHint int) (io.WriteCloser, RSV, error) {
+	if sizeHint < zc.threshold {
+		return nil, 0, nil
+	}
+	return zc.compressMessage(w, typ)
+}
+
+func (zc *zstdConn) shouldCompress(typ MessageType, p []byte) bool {
+	return len(p) >= zc.threshold
+}
+
+func (zc *zstdConn) compressMessage(w io.Writer, typ MessageType) (io.WriteCloser, RSV, error) {
+	err := zc.zw.reset(w)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create zstd encoder: %w", err)
+	}
+	return &zc.zw, RSV1, nil
+}
+
+func (zc *zstdConn) ReadMessage(r io.Reader, typ MessageType, rsv RSV) (io.Reader, error) {
+	if rsv&RSV1 == 0 {
+		return r, nil
+	}
+	err := zc.zr.reset(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+	}
+	return &zc.zr, nil
+}
+
+// pooled reports whether the encoder and decoder are pooled
+// as they are not configured with a dictionary.
+func (zc *zstdConn) pooled() bool {
+	return zc.dict == nil
+}
+
+func (zc *zstdConn) newEncoder() (*zstd.Encoder, error) {
+	if zc.pooled() {
+		enc, ok := zstdEncoderPools[zc.level-zstd.SpeedFastest].Get().(*zstd.Encoder)
+		if ok {
+			return enc, nil
+		}
+	}
+
+	opts := []zstd.EOption{
+		zstd.WithEncoderLevel(zc.level),
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithWindowSize(zstdWindowSize),
+		zstd.WithLowerEncoderMem(true),
+		// WebSocket runs over a reliable transport.
+		zstd.WithEncoderCRC(false),
+	}
+	if zc.dict != nil && zc.dict.raw {
+		opts = append(opts, zstd.WithEncoderDictRaw(zc.dict.id, zc.dict.content))
+	} else if zc.dict != nil {
+		opts = append(opts, zstd.WithEncoderDict(zc.dict.content))
+	}
+	return zstd.NewWriter(nil, opts...)
+}
+
+func (zc *zstdConn) putEncoder(enc *zstd.Encoder) {
+	// Drop the reference to the destination.
+	enc.Reset(nil)
+	if zc.pooled() {
+		zstdEncoderPools[zc.level-zstd.SpeedFastest].Put(enc)
+	}
+}
+
+func (zc *zstdConn) newDecoder() (*zstd.Decoder, error) {
+	if zc.pooled() {
+		dec, ok := zstdDecoderPool.Get().(*zstd.Decoder)
+		if ok {
+			return dec, nil
+		}
+	}
+
+	opts := []zstd.DOption{
+		// Decodes synchronously as blocks are read.
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderLowmem(true),
+		zstd.WithDecoderMaxWindow(zstdWindowSize),
+	}
+	if zc.dict != nil && zc.dict.raw {
+		opts = append(opts, zstd.WithDecoderDictRaw(zc.dict.id, zc.dict.content))
+	} else if zc.dict != nil {
+		opts = append(opts, zstd.WithDecoderDicts(zc.dict.content))
+	}
+	return zstd.NewReader(nil, opts...)
+}
+
+func (zc *zstdConn) putDecoder(dec *zstd.Decoder) {
+	if zc.pooled() {
+		// Drop the reference to the source.
+		dec.Reset(nil)
+		zstdDecoderPool.Put(dec)
+		return
+	}
+	dec.Close()
+}
+
+// zstdEncoderPools holds a pool of zstd.Encoder for every level
+// from zstd.SpeedFastest to zstd.SpeedBestCompression.
+var zstdEncoderPools [zstd.SpeedBestCompression - zstd.SpeedFastest + 1]sync.Pool
+
+var zstdDecoderPool sync.Pool
+
+// zstdWriter compresses a message as a zstd frame or, with context
+// takeover, as the next blocks of a single zstd frame.
+type zstdWriter struct {
+	zc              *zstdConn
+	contextTakeover bool
+
+	w io.Writer
+	// dst writes to w and is the stable destination of enc.
+	dst writerFunc
+	enc *zstd.Encoder
+}
+
+func (zw *zstdWriter) reset(w io.Writer) error {
+	zw.w = w
+	if zw.dst == nil {
+		zw.dst = func(p []byte) (int, error) {
+			return zw.w.Write(p)
+		}
+	}
+
+	if zw.enc != nil && zw.contextTakeover {
+		return nil
+	}
+	if zw.enc == nil {
+		var err error
+		zw.enc, err = zw.zc.newEncoder()
+		if err != nil {
+			return err
+		}
+	}
+	zw.enc.Reset(zw.dst)
+	return nil
+}
+
+func (zw *zstdWriter) Write(p []byte) (int, error) {
+	return zw.enc.Write(p)
+}
+
+func (zw *zstdWriter) Close() error {
+	if zw.contextTakeover {
+		// Flushing ends the message with a complete block
+		// without ending the frame.
+		return zw.enc.Flush()
+	}
+
+	err := zw.enc.Close()
+	if zw.zc.pooled() {
+		zw.close()
+	}
+	return err
+}
+
+func (zw *zstdWriter) close() {
+	if zw.enc != nil {
+		zw.zc.putEncoder(zw.enc)
+		zw.enc = nil
+	}
+	zw.w = nil
+}
+
+// zstdReader decompresses a message written by zstdWriter.
+//
+// The decoder reads blocks from the message on demand but fails once the
+// message ends if asked for another block. So the message is checked
+// for more bytes before asking for one and every block is decompressed
+// at once into buf so that the decoder never holds onto part of it.
+type zstdReader struct {
+	zc              *zstdConn
+	contextTakeover bool
+
+	src     io.Reader
+	srcFunc readerFunc
+	peek    [1]byte
+	peeked  bool
+
+	dec *zstd.Decoder
+	buf []byte
+	off int
+}
+
+func (zr *zstdReader) reset(r io.Reader) error {
+	zr.src = r
+	zr.peeked = false
+	if zr.buf == nil {
+		zr.buf = getZstdBlock()
+	}
+	zr.buf = zr.buf[:0]
+	zr.off = 0
+	if zr.srcFunc == nil {
+		zr.srcFunc = zr.readSrc
+	}
+
+	if zr.dec != nil && zr.contextTakeover {
+		return nil
+	}
+	if zr.dec == nil {
+		var err error
+		zr.dec, err = zr.zc.newDecoder()
+		if err != nil {
+			return err
+		}
+	}
+	return zr.dec.Reset(zr.srcFunc)
+}
+
+func (zr *zstdReader) readSrc(p []byte) (int, error) {
+	if zr.peeked && len(p) > 0 {
+		p[0] = zr.peek[0]
+		zr.peeked = false
+		return 1, nil
+	}
+	return zr.src.Read(p)
+}
+
+// more reports whether the message has more bytes by peeking at the next.
+func (zr *zstdReader) more() (bool, error) {
+	if zr.peeked {
+		return true, nil
+	}
+	for {
+		n, err := zr.src.Read(zr.peek[:])
+		if n == 1 {
+			zr.peeked = true
+			return true, nil
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+func (zr *zstdReader) Read(p []byte) (int, error) {
+	if zr.buf == nil {
+		return 0, io.EOF
+	}
+
+	if zr.off == len(zr.buf) {
+		more, err := zr.more()
+		if err != nil {
+			return 0, err
+		}
+		if !more {
+			zr.done()
+			return 0, io.EOF
+		}
+
+		n, err := zr.dec.Read(zr.buf[:cap(zr.buf)])
+		zr.buf = zr.buf[:n]
+		zr.off = 0
+		if n == cap(zr.buf) {
+			return 0, errors.New("zstd block decompresses to more than the maximum block size")
+		}
+		if err == io.EOF && !zr.contextTakeover {
+			// The frame ended with an empty block.
+			zr.done()
+			return 0, io.EOF
+		}
+		if err == io.EOF {
+			// The decoder cannot continue the stream.
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, zr.buf[zr.off:])
+	zr.off += n
+	return n, nil
+}
+
+// done releases what is not needed in between messages.
+func (zr *zstdReader) done() {
+	putZstdBlock(zr.buf)
+	zr.buf = nil
+	zr.src = nil
+	if !zr.contextTakeover && zr.zc.pooled() && zr.dec != nil {
+		zr.zc.putDecoder(zr.dec)
+		zr.dec = nil
+	}
+}
+
+func (zr *zstdReader) close() {
+	if zr.buf != nil {
+		putZstdBlock(zr.buf)
+		zr.buf = nil
+	}
+	if zr.dec != nil {
+		zr.zc.putDecoder(zr.dec)
+		zr.dec = nil
+	}
+}
+
+var zstdBlockPool sync.Pool
+
+// getZstdBlock returns a buffer that fits any block with a byte to spare
+// to tell whether the decoder had more to return.
+func getZstdBlock() []byte {
+	b, ok := zstdBlockPool.Get().([]byte)
+	if !ok {
+		return make([]byte, 0, zstdMaxBlockSize+1)
+	}
+	return b
+}
+
+func putZstdBlock(b []byte) {
+	zstdBlockPool.Put(b)
+}
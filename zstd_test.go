@@ -0,0 +1,135 @@
+// +build !js
+
+package websocket
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"nhooyr.io/websocket/internal/test/assert"
+	"nhooyr.io/websocket/internal/test/xrand"
+)
+
+func Test_zstdConn(t *testing.T) {
+	t.Parallel()
+
+	dict := []byte(strings.Repeat(`{"type":"update","status":"online"}`, 10))
+	for _, mode := range []CompressionMode{CompressionContextTakeover, CompressionNoContextTakeover} {
+		for _, dict := range [][]byte{nil, dict} {
+			e := newZstdExtension(&ZstdOptions{
+				Mode:       mode,
+				Threshold:  1,
+				Level:      1 + xrand.Int(zstdMaxLevel),
+				Dictionary: dict,
+			})
+			t.Run(fmt.Sprintf("%v/%v", mode, dict != nil), func(t *testing.T) {
+				t.Parallel()
+				testZstdConn(t, e)
+			})
+		}
+	}
+}
+
+func testZstdConn(t *testing.T, e zstdExtension) {
+	copts := e.mode.opts()
+	client := e.newConn(copts, e.dict, true)
+	defer client.Close()
+	server := e.newConn(copts, e.dict, false)
+	defer server.Close()
+
+	for i := 0; i < 10; i++ {
+		// Large messages span several blocks.
+		msg := strings.Repeat(xrand.String(1+xrand.Int(128)), 1+xrand.Int(2048))
+
+		var buf bytes.Buffer
+		w, rsv, err := client.WriteMessage(&buf, MessageText, len(msg))
+		assert.Success(t, err)
+		assert.Equal(t, "rsv", RSV1, rsv)
+		for p := msg; len(p) > 0; {
+			n := 1 + xrand.Int(len(p))
+			_, err = w.Write([]byte(p[:n]))
+			assert.Success(t, err)
+			p = p[n:]
+		}
+		err = w.Close()
+		assert.Success(t, err)
+
+		r, err := server.ReadMessage(&buf, MessageText, rsv)
+		assert.Success(t, err)
+		b, err := ioutil.ReadAll(r)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", msg, string(b))
+	}
+}
+
+func Test_zstdExtension(t *testing.T) {
+	t.Parallel()
+
+	dict := []byte(strings.Repeat("hello world ", 10))
+	client := newZstdExtension(&ZstdOptions{
+		Dictionary: dict,
+	})
+	dictID := fmt.Sprintf("dict_id=%d", client.dict.id)
+	assert.Equal(t, "offer", []string{"client_no_context_takeover", "server_no_context_takeover", dictID}, client.Offer())
+
+	t.Run("dict", func(t *testing.T) {
+		t.Parallel()
+
+		server := newZstdExtension(&ZstdOptions{
+			Mode:       CompressionContextTakeover,
+			Dictionary: dict,
+		})
+		ec, params, err := server.Accept(client.Offer())
+		assert.Success(t, err)
+		defer ec.Close()
+		assert.Equal(t, "params", []string{"client_no_context_takeover", "server_no_context_takeover", dictID}, params)
+		assert.Equal(t, "dict", client.dict.id, ec.(*zstdConn).dict.id)
+
+		ec, err = client.Negotiated(params)
+		assert.Success(t, err)
+		defer ec.Close()
+		assert.Equal(t, "dict", client.dict.id, ec.(*zstdConn).dict.id)
+	})
+
+	t.Run("otherDict", func(t *testing.T) {
+		t.Parallel()
+
+		server := newZstdExtension(&ZstdOptions{
+			Dictionary: []byte("other"),
+		})
+		ec, params, err := server.Accept(client.Offer())
+		assert.Success(t, err)
+		defer ec.Close()
+		assert.Equal(t, "params", []string{"client_no_context_takeover", "server_no_context_takeover"}, params)
+		assert.Equal(t, "dict", (*zstdDict)(nil), ec.(*zstdConn).dict)
+
+		ec, err = client.Negotiated(params)
+		assert.Success(t, err)
+		defer ec.Close()
+		assert.Equal(t, "dict", (*zstdDict)(nil), ec.(*zstdConn).dict)
+	})
+
+	t.Run("unexpectedDict", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := client.Negotiated([]string{"dict_id=1"})
+		assert.Contains(t, err, "unexpected")
+	})
+
+	t.Run("badParam", func(t *testing.T) {
+		t.Parallel()
+
+		ec, params, err := client.Accept([]string{"dict_id=0x1"})
+		assert.Success(t, err)
+		assert.Equal(t, "ec", nil, ec)
+		assert.Equal(t, "params", []string(nil), params)
+
+		ec, params, err = client.Accept([]string{"server_max_window_bits=10"})
+		assert.Success(t, err)
+		assert.Equal(t, "ec", nil, ec)
+		assert.Equal(t, "params", []string(nil), params)
+	})
+}